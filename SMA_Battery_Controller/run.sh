@@ -13,6 +13,119 @@ export MODBUS_INTERVAL_IN_SECONDS=$(bashio::config 'modbus_interval_in_seconds')
 export RESET_INTERVAL_MINUTES=$(bashio::config 'reset_interval_minutes')
 export DEVICE_ID=$(bashio::config 'device_id')
 export POST_COMMAND_DELAY_MS=$(bashio::config 'post_command_delay_ms')
+export WRITE_ORDER=$(bashio::config 'write_order')
+export RETAIN_STATE=$(bashio::config 'retain_state')
+export MODE_BUTTONS=$(bashio::config 'mode_buttons')
+export MODBUS_RECONNECT_EACH_POLL=$(bashio::config 'modbus_reconnect_each_poll')
+export POLL_JITTER_PERCENT=$(bashio::config 'poll_jitter_percent')
+export POWER_FLOW_TOPIC=$(bashio::config 'power_flow_topic')
+export MINIMUM_SOC=$(bashio::config 'minimum_soc')
+export MAXIMUM_SOC=$(bashio::config 'maximum_soc')
+export VALIDATE_BATTERY_CONTROL_SOC=$(bashio::config 'validate_battery_control_soc')
+export ENERGY_OUTPUT=$(bashio::config 'energy_output')
+export READ_WATCHDOG_SECONDS=$(bashio::config 'read_watchdog_seconds')
+export READ_WATCHDOG_MAX_RESTARTS=$(bashio::config 'read_watchdog_max_restarts')
+export GRID_DRAW_CORRECTION=$(bashio::config 'grid_draw_correction')
+export GRID_FEED_CORRECTION=$(bashio::config 'grid_feed_correction')
+export AC_POWER_CORRECTION=$(bashio::config 'ac_power_correction')
+export BATTERY_CHARGE_POWER_CORRECTION=$(bashio::config 'battery_charge_power_correction')
+export BATTERY_DISCHARGE_POWER_CORRECTION=$(bashio::config 'battery_discharge_power_correction')
+export DC1_POWER_CORRECTION=$(bashio::config 'dc1_power_correction')
+export DC2_POWER_CORRECTION=$(bashio::config 'dc2_power_correction')
+export ZERO_CONTROL_POLICY=$(bashio::config 'zero_control_policy')
+export BALANCED_ALGORITHM=$(bashio::config 'balanced_algorithm')
+export BALANCED_GAIN=$(bashio::config 'balanced_gain')
+export BALANCED_DEADBAND_W=$(bashio::config 'balanced_deadband_w')
+export PUBLISH_MODBUS_UPTIME=$(bashio::config 'publish_modbus_uptime')
+export SOFT_START_CYCLES=$(bashio::config 'soft_start_cycles')
+export ECO_START=$(bashio::config 'eco_start')
+export ECO_END=$(bashio::config 'eco_end')
+export ECO_INTERVAL_SECONDS=$(bashio::config 'eco_interval_seconds')
+export ECO_RELEASE_CONTROL=$(bashio::config 'eco_release_control')
+export ACK_TOPIC=$(bashio::config 'ack_topic')
+export BATTERY_STATUS_TEXT=$(bashio::config 'battery_status_text')
+export BATTERY_STATUS_MAP=$(bashio::config 'battery_status_map')
+export PUBLISH_POLL_COUNTERS=$(bashio::config 'publish_poll_counters')
+export SOLAR_ONLY_CHARGE=$(bashio::config 'solar_only_charge')
+export CONTROL_MIN_ON_SECONDS=$(bashio::config 'control_min_on_seconds')
+export CONTROL_MIN_OFF_SECONDS=$(bashio::config 'control_min_off_seconds')
+export PUBLISH_REGISTER_MAP=$(bashio::config 'publish_register_map')
+export BALANCED_BACKOFF_ERRORS_PER_MINUTE=$(bashio::config 'balanced_backoff_errors_per_minute')
+export DEBUG_RAW_CONTROL=$(bashio::config 'debug_raw_control')
+export PER_SENSOR_AVAILABILITY=$(bashio::config 'per_sensor_availability')
+export MQTT_DISCONNECT_MODE=$(bashio::config 'mqtt_disconnect_mode')
+export MQTT_DISCONNECT_GRACE_SECONDS=$(bashio::config 'mqtt_disconnect_grace_seconds')
+export DECISION_SNAPSHOT=$(bashio::config 'decision_snapshot')
+export INVERTER_AC_LIMIT_W=$(bashio::config 'inverter_ac_limit_w')
+export CLIPPING_MARGIN_W=$(bashio::config 'clipping_margin_w')
+export DISCOVERY_REPUBLISH_MIN_SECONDS=$(bashio::config 'discovery_republish_min_seconds')
+export COMBINED_CONTROL_WRITE=$(bashio::config 'combined_control_write')
+export DEBUG_RAW_WRITES=$(bashio::config 'debug_raw_writes')
+export AUTOMATIC_INITIAL_WRITE=$(bashio::config 'automatic_initial_write')
+export RECONNECT_SETTLE_POLLS=$(bashio::config 'reconnect_settle_polls')
+export SENSOR_BOUNDS=$(bashio::config 'sensor_bounds')
+export SENSOR_BOUNDS_ACTION=$(bashio::config 'sensor_bounds_action')
+export BATTERY_ENERGY_TOTALS=$(bashio::config 'battery_energy_totals')
+export ENERGY_STATE_FILE=$(bashio::config 'energy_state_file')
+export GRID_SENSE_INVERT=$(bashio::config 'grid_sense_invert')
+export HEARTBEAT_TOPIC=$(bashio::config 'heartbeat_topic')
+export POLL_GROUP_INTERVALS=$(bashio::config 'poll_group_intervals')
+export REGISTER_POLL_GROUPS=$(bashio::config 'register_poll_groups')
+export PUBLISH_HOUSE_LOAD=$(bashio::config 'publish_house_load')
+export WAIT_FOR_FIRST_POLL=$(bashio::config 'wait_for_first_poll')
+export PUBLISH_INVERTER_EFFICIENCY=$(bashio::config 'publish_inverter_efficiency')
+export EFFICIENCY_MIN_POWER_W=$(bashio::config 'efficiency_min_power_w')
+export BALANCED_RETURN_SETPOINT=$(bashio::config 'balanced_return_setpoint')
+export PUBLISH_STARTUP_RESTORE=$(bashio::config 'publish_startup_restore')
+export SIGNED_SENTINELS=$(bashio::config 'signed_sentinels')
+export UNSIGNED_SENTINELS=$(bashio::config 'unsigned_sentinels')
+export MODBUS_SLAVE_ID=$(bashio::config 'modbus_slave_id')
+export MODBUS_MODE=$(bashio::config 'modbus_mode')
+export MODBUS_SERIAL_DEVICE=$(bashio::config 'modbus_serial_device')
+export MODBUS_BAUD_RATE=$(bashio::config 'modbus_baud_rate')
+export MODBUS_DATA_BITS=$(bashio::config 'modbus_data_bits')
+export MODBUS_PARITY=$(bashio::config 'modbus_parity')
+export MODBUS_STOP_BITS=$(bashio::config 'modbus_stop_bits')
+export MODBUS_BATCH_READS=$(bashio::config 'modbus_batch_reads')
+export MODBUS_BATCH_GAP_WORDS=$(bashio::config 'modbus_batch_gap_words')
+export PUBLISH_PHASE_POWER=$(bashio::config 'publish_phase_power')
+export PUBLISH_ENERGY_COUNTERS=$(bashio::config 'publish_energy_counters')
+export REGISTER_MAP_FILE=$(bashio::config 'register_map_file')
+export SOC_HYSTERESIS=$(bashio::config 'soc_hysteresis')
+export PEAK_SHAVE_LIMIT_W=$(bashio::config 'peak_shave_limit_w')
+export SCHEDULE=$(bashio::config 'schedule')
+export SCHEDULE_TIMEZONE=$(bashio::config 'schedule_timezone')
+export MQTT_MAX_RECONNECT_INTERVAL_SECONDS=$(bashio::config 'mqtt_max_reconnect_interval_seconds')
+export DISCOVERY_PREFIX=$(bashio::config 'discovery_prefix')
+export STATUS_TOPIC=$(bashio::config 'status_topic')
+export LOG_LEVEL=$(bashio::config 'log_level')
+export LOG_FORMAT=$(bashio::config 'log_format')
+export METRICS_PORT=$(bashio::config 'metrics_port')
+export HEALTH_PORT=$(bashio::config 'health_port')
+export HEALTH_MAX_POLL_AGE_SECONDS=$(bashio::config 'health_max_poll_age_seconds')
+export MODBUS_RECOVERY_MAX_ATTEMPTS=$(bashio::config 'modbus_recovery_max_attempts')
+export MODBUS_BACKOFF_MAX_SECONDS=$(bashio::config 'modbus_backoff_max_seconds')
+export WRITE_READBACK_VERIFY=$(bashio::config 'write_readback_verify')
+export WRITE_READBACK_RETRIES=$(bashio::config 'write_readback_retries')
+export PUBLISH_SELF_SUFFICIENCY=$(bashio::config 'publish_self_sufficiency')
+export BALANCED_INTERVAL_SECONDS=$(bashio::config 'balanced_interval_seconds')
+export INVERTERS=$(bashio::config 'inverters')
+export DRY_RUN=$(bashio::config 'dry_run')
+export CONTROL_REGISTER=$(bashio::config 'control_register')
+export POWER_REGISTER=$(bashio::config 'power_register')
+export CONTROL_ON_CODE=$(bashio::config 'control_on_code')
+export CONTROL_OFF_CODE=$(bashio::config 'control_off_code')
+export INITIAL_SETTINGS_TIMEOUT_MS=$(bashio::config 'initial_settings_timeout_ms')
+export MQTT_QOS=$(bashio::config 'mqtt_qos')
+export PAUSE_RELEASE_EXPORT_W=$(bashio::config 'pause_release_export_w')
+export PAUSE_HOLD_EXPORT_W=$(bashio::config 'pause_hold_export_w')
+export PAUSE_MIN_DWELL_SECONDS=$(bashio::config 'pause_min_dwell_seconds')
+export OVERWRITE_TIMEOUT_MINUTES=$(bashio::config 'overwrite_timeout_minutes')
+export RAW_ATTRIBUTES=$(bashio::config 'raw_attributes')
+export MIN_WRITE_INTERVAL_MS=$(bashio::config 'min_write_interval_ms')
+export MIN_WRITE_DELTA_W=$(bashio::config 'min_write_delta_w')
+export ZERO_EXPORT_LIMIT_REGISTER=$(bashio::config 'zero_export_limit_register')
+export SMA_INVERTER_SERIAL=$(bashio::config 'sma_inverter_serial')
 
 # Run the Go application
 exec /sma_battery_controller
\ No newline at end of file
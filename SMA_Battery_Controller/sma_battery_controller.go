@@ -1,56 +1,366 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"math"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	modbus "github.com/goburrow/modbus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/yaml.v3"
 )
 
+// ModbusClient is the subset of modbus.Client the controller uses, so the control logic can run
+// against a fake client instead of a real inverter
+type ModbusClient interface {
+	ReadInputRegisters(address, quantity uint16) (results []byte, err error)
+	ReadHoldingRegisters(address, quantity uint16) (results []byte, err error)
+	WriteMultipleRegisters(address, quantity uint16, value []byte) (results []byte, err error)
+}
+
+// modbusConnection is the connect/close part of the TCP and RTU client handlers
+type modbusConnection interface {
+	Connect() error
+	Close() error
+}
+
 // regDef describes a Modbus input register we poll and expose
 type regDef struct {
-	name string
-	addr uint16
+	name   string
+	addr   uint16
+	scale  float64 // Factor applied to the raw value; 0 means 1.0
+	unit   string  // Unit of the scaled value
+	signed bool    // S32/S64 register; otherwise U32/U64
+	words  uint16  // Register width in words: 2 (32-bit) or 4 (64-bit); 0 means 2
+
+	// Discovery classes, only used for registers loaded from REGISTER_MAP_FILE
+	deviceClass string
+	stateClass  string
 }
 
-var (
-	mqttClient              mqtt.Client
-	modbusClient            modbus.Client
-	modbusClientErrorCount  int
-	modbusClientErrorTime   time.Time
-	maximumBatteryControl   int
-	modbusIntervalInSeconds int
-	debugEnabled            bool
-	automaticLogicSelection string
-	overwriteLogicSelection string
-	currentLogicSelection   string
-	batteryControl          int
-	lastValidBatteryControl int
-	batteryDischargePower   int
-	batteryChargePower      int
-	previousMode            string
-	deviceID                string
-	resetIntervalMinutes    int       // Reset interval
-	lastChangeTime          time.Time // Last change timestamp
-	initialValuesLoaded     bool      // Track if values are loaded
-	acPower                 int
-	gridDraw                int
-	gridFeed                int
-	pauseActivated          bool
-	postCommandDelayMs      int // Delay after write before readback
+// registerMapEntry is one register in a REGISTER_MAP_FILE (JSON or YAML)
+type registerMapEntry struct {
+	Name        string  `json:"name" yaml:"name"`
+	Address     uint16  `json:"address" yaml:"address"`
+	Words       uint16  `json:"words" yaml:"words"`
+	Scale       float64 `json:"scale" yaml:"scale"`
+	Unit        string  `json:"unit" yaml:"unit"`
+	Signed      bool    `json:"signed" yaml:"signed"`
+	DeviceClass string  `json:"device_class" yaml:"device_class"`
+	StateClass  string  `json:"state_class" yaml:"state_class"`
+}
+
+// wordCount returns the register width in words, treating an unset (0) width as 2
+func (r regDef) wordCount() uint16 {
+	if r.words == 0 {
+		return 2
+	}
+	return r.words
+}
+
+// rawValue extracts the big-endian 32- or 64-bit raw value from the register data
+func (r regDef) rawValue(data []byte) uint64 {
+	if r.wordCount() == 4 {
+		return binary.BigEndian.Uint64(data)
+	}
+	return uint64(binary.BigEndian.Uint32(data))
+}
+
+// isSentinel reports whether raw is an SMA "not available" value for the register's data type
+func (r regDef) isSentinel(raw uint64, signedSentinels, unsignedSentinels []uint32) bool {
+	if r.wordCount() == 4 {
+		// 64-bit counters: 0x8000000000000000 (S64) or 0xFFFFFFFFFFFFFFFF (U64)
+		return (r.signed && raw == 1<<63) || (!r.signed && raw == math.MaxUint64)
+	}
+	sentinels := unsignedSentinels
+	if r.signed {
+		sentinels = signedSentinels
+	}
+	for _, sentinel := range sentinels {
+		if uint32(raw) == sentinel {
+			return true
+		}
+	}
+	return false
+}
+
+// decode interprets the raw register value as signed or unsigned
+func (r regDef) decode(raw uint64) int64 {
+	if r.wordCount() == 4 {
+		return int64(raw)
+	}
+	if r.signed {
+		return int64(int32(raw))
+	}
+	return int64(raw)
+}
+
+// scaleFactor returns the register's scale, treating an unset (0) scale as 1.0
+func (r regDef) scaleFactor() float64 {
+	if r.scale == 0 {
+		return 1
+	}
+	return r.scale
+}
+
+// controlInputs is the copy of the polled values a control decision works from, taken under gridMu
+type controlInputs struct {
+	gridDraw              int
+	gridFeed              int
+	netGrid               int
+	batteryChargePower    int
+	batteryDischargePower int
+	acPower               int
+	dc1Power              int
+	dc2Power              int
+	batterySoc            int
+	batterySocKnown       bool
+	peakShaveLimitW       int
+}
+
+// valueBounds is an optional sanity range for a register's scaled value; nil means unbounded
+type valueBounds struct {
+	min *float64
+	max *float64
+}
+
+// Controller runs one inverter: its Modbus and MQTT clients, topics, configuration and control state.
+// Options come from the environment, with per-inverter overrides from INVERTERS in env.
+type Controller struct {
+	env       map[string]string // Option overrides for this inverter (environment variable name to value)
+	logDevice bool              // Tag log messages with the device ID (more than one inverter)
+
+	mqttClient                      mqtt.Client
+	modbusClient                    ModbusClient
+	modbusHandler                   modbusConnection
+	modbusClientErrorCount          atomic.Int64 // Read by /healthz and the metrics
+	modbusClientErrorTime           time.Time    // Last Modbus error (guarded by statusMu)
+	maximumBatteryControl           int
+	modbusIntervalInSeconds         int
+	automaticLogicSelection         string // Guarded by controlMu
+	overwriteLogicSelection         string // Guarded by controlMu
+	currentLogicSelection           string
+	batteryControl                  int // Guarded by controlMu
+	lastValidBatteryControl         int
+	batteryDischargePower           int
+	batteryChargePower              int
+	batterySoc                      int  // Last battery_soc reading (%)
+	batterySocKnown                 bool // batterySoc holds a successful reading
+	previousMode                    string
+	deviceID                        string
+	resetIntervalMinutes            int       // Reset interval
+	lastChangeTime                  time.Time // Last change timestamp (guarded by controlMu)
+	initialValuesLoaded             bool      // Track if values are loaded
+	acPower                         int
+	gridDraw                        int
+	gridFeed                        int
+	netGrid                         int           // gridDraw - gridFeed, computed once per poll
+	inputs                          controlInputs // Polled values of the current control decision (guarded by controlMu)
+	dc1Power                        int
+	dc2Power                        int
+	pauseActivated                  bool
+	postCommandDelayMs              int                         // Delay after write before readback
+	writeOrder                      string                      // "control_first" (40151 then 40149) or "power_first"
+	retainState                     bool                        // Retain sensor state messages (discovery is always retained)
+	modeButtonsEnabled              bool                        // Publish one button per mode for dashboards
+	modbusReconnectEachPoll         bool                        // Connect, read the batch and close on every poll cycle
+	pollJitterPercent               int                         // Random ± jitter applied to the normal poll interval
+	powerFlowTopic                  string                      // Topic for the consolidated power flow JSON ("" disables)
+	minimumSoc                      int                         // SOC floor (%) for discharge
+	maximumSoc                      int                         // SOC ceiling (%) for charge
+	validateControlSoc              bool                        // Reject battery_control changes that conflict with the SOC limits
+	energyOutput                    string                      // "none", "measurement" (same as none) or "energy" (integrated kWh)
+	readWatchdogSeconds             int                         // Reconnect if no poll fully succeeded for this long (0 disables)
+	readWatchdogMaxRestarts         int                         // Exit after this many watchdog reconnects without success (0 never exits)
+	readWatchdogRestarts            int                         // Watchdog reconnects since the last fully successful poll
+	lastFullPoll                    time.Time                   // Time of the last poll without read errors, restarted by the watchdog (read loop only)
+	lastSuccessfulPoll              time.Time                   // Time of the last poll without read errors (guarded by statusMu)
+	powerCorrections                map[string]float64          // Multiplicative correction per power register (only factors != 1)
+	modbusReconnecting              bool                        // A reconnect after a Modbus error is pending
+	lastWriteFailed                 bool                        // The last control write failed
+	lastSpntCom                     uint32                      // Last successfully written control method
+	lastPwrAtCom                    int32                       // Last successfully written power command
+	ackTopic                        string                      // Topic for command acknowledgements ("" disables)
+	enumTexts                       map[string]map[int64]string // Code to text decoding per enum register
+	publishPollCounters             bool                        // Publish the poll/publish diagnostic counters
+	pollsTotal                      int64                       // Completed poll cycles
+	registersReadTotal              int64                       // Successful register reads
+	publishesTotal                  atomic.Int64                // Sensor state publishes sent
+	publishesSuppressedTotal        atomic.Int64                // Sensor state publishes skipped by the cache
+	zeroControlPolicy               string                      // "legacy", "release" or "hold" for battery_control == 0
+	balancedAlgorithm               string                      // "legacy" (multi-branch) or "proportional"
+	balancedGain                    float64                     // Proportional gain for Balanced
+	balancedDeadbandW               int                         // Net grid deviation (W) ignored by Balanced
+	balancedSetpoint                int                         // Signed proportional setpoint (W, + discharge / - charge)
+	publishModbusUptime             bool                        // Publish the modbus_uptime diagnostic sensor
+	modbusConnectedAt               time.Time                   // Time the current Modbus connection was established
+	softStartCycles                 int                         // Poll cycles to ramp the power command after enabling control (0 disables)
+	softStartStep                   int                         // Current soft-start step
+	ecoStartMinute                  int                         // Eco window start (minutes since midnight, -1 disables)
+	ecoEndMinute                    int                         // Eco window end (minutes since midnight)
+	ecoIntervalSeconds              int                         // Poll interval while in eco
+	ecoReleaseControl               bool                        // Release control (controlOff) when entering eco
+	ecoActive                       bool                        // Eco low-activity state is active (written under controlMu)
+	lastEcoPoll                     time.Time                   // Last poll while in eco
+	inverterAddress                 string                      // Inverter IP, resolved by discovery when configured as "auto"
+	inverterAutoDiscover            bool                        // Find the inverter by Speedwire discovery on every (re)connect
+	inverterSerial                  uint32                      // Serial number discovery must match (0 = first inverter found)
+	solarOnlyCharge                 bool                        // Cap Charge Battery to the PV surplus
+	controlMinOnSeconds             int                         // Minimum time control stays enabled before it may be released
+	controlMinOffSeconds            int                         // Minimum time control stays released before it may be enabled
+	lastControlChange               time.Time                   // Last time the written control method changed
+	publishRegisterMapEnabled       bool                        // Log and publish the resolved register table at startup
+	balancedBackoffErrors           int                         // Read errors per minute that suspend the fast Balanced poll (0 disables)
+	balancedBackoff                 bool                        // Fast Balanced poll is suspended because of read errors
+	recentReadErrors                []time.Time                 // Read error timestamps of the last minute (guarded by readErrorsMu)
+	debugRawControl                 bool                        // Expose raw_control_method/raw_power_command numbers
+	rawControlActive                bool                        // Raw debug control currently owns the control registers
+	rawSpntCom                      uint32                      // Raw control method set over MQTT
+	rawPwrAtCom                     int32                       // Raw power command set over MQTT
+	perSensorAvailability           bool                        // Publish an availability topic per polled sensor
+	sensorAvailable                 map[string]bool             // Last published availability per sensor
+	mqttConnected                   bool                        // MQTT broker connection is up (guarded by statusMu)
+	mqttDisconnectedAt              time.Time                   // Time the MQTT connection was lost (guarded by statusMu)
+	mqttDisconnectMode              string                      // Mode used while MQTT is disconnected ("" keeps the current mode)
+	mqttDisconnectGraceSeconds      int                         // Disconnect time before switching to mqttDisconnectMode
+	mqttFallbackActive              bool                        // mqttDisconnectMode is currently applied (guarded by controlMu)
+	mqttFallbackSaved               string                      // Overwrite selection to restore when MQTT returns (guarded by controlMu)
+	decisionSnapshotEnabled         bool                        // Publish the control_decision diagnostic sensor
+	decisionBranch                  string                      // Branch taken by the last control decision
+	inverterAcLimitW                int                         // Inverter AC power limit used for clipping detection (0 disables the pinned check)
+	clippingMarginW                 int                         // Margin (W) for clipping detection
+	discoveryRepublishMinSeconds    int                         // Minimum seconds between discovery republishes on HA birth
+	lastDiscoveryPublish            time.Time                   // Time of the last discovery publish
+	discoveryMu                     sync.Mutex                  // Serializes discovery republishes
+	combinedControlWrite            bool                        // Write 40149 and 40151 in one WriteMultipleRegisters call when adjacent
+	debugRawWrites                  bool                        // Log and publish the raw bytes of every control write
+	automaticInitialWrite           string                      // "always" or "readback" (skip the first Automatic release unless 40151 shows control)
+	initialAutomaticChecked         bool                        // First Automatic evaluation handled
+	initialControlMethodRead        bool                        // The read loop has read 40151 for automaticInitialWrite=readback
+	initialControlMethod            uint32                      // 40151 at startup, valid when initialControlMethodErr is nil
+	initialControlMethodErr         error                       // Error of the startup 40151 read
+	reconnectSettlePolls            int                         // Polls after a Modbus reconnect whose values are read but not published
+	settlePollsRemaining            int                         // Remaining settle polls after the last reconnect
+	sensorBounds                    map[string]valueBounds      // Optional sanity bounds per register
+	sensorBoundsAction              string                      // "drop" or "unavailable" for out-of-range values
+	batteryEnergyTotals             bool                        // Publish battery charged/discharged kWh totals
+	energyStateFile                 string                      // File that persists the battery energy totals ("" = reset on restart)
+	batteryTotals                   map[string]float64          // kWh per battery total sensor (guarded by energyMu)
+	batteryTotalSamples             map[string]powerSample      // Previous battery power sample (guarded by energyMu)
+	lastEnergyStateSave             time.Time                   // Last write of energyStateFile (guarded by energyMu)
+	gridSenseInvert                 bool                        // Swap grid_feed and grid_draw for a reversed grid CT
+	heartbeatTopic                  string                      // Topic for the heartbeat counter ("" = disabled)
+	heartbeatCount                  int64                       // Successful polls since start
+	pollGroupIntervals              map[string]int              // Seconds between reads per polling group (0 = every poll)
+	registerPollGroups              map[string]string           // Polling group per register
+	lastRegisterPoll                map[string]time.Time        // Last read attempt per register (read loop only)
+	publishHouseLoad                bool                        // Publish the derived house_load sensor
+	waitForFirstPoll                bool                        // Defer control until the first successful poll
+	controlInputsReady              bool                        // A poll without read errors has populated the control inputs
+	controlDeferred                 bool                        // An evaluation was deferred and runs after the next poll
+	publishInverterEfficiency       bool                        // Publish the derived inverter_efficiency sensor
+	efficiencyMinPowerW             int                         // Minimum DC input for the efficiency calculation
+	balancedReturnSetpoint          string                      // battery_control after leaving Balanced: "hold", "restore" or "default"
+	balancedActive                  bool                        // Balanced is the active overwrite mode
+	balancedEntryBatteryControl     int                         // battery_control when Balanced was activated
+	publishStartupRestore           bool                        // Publish the startup_restore diagnostic sensor
+	restoredSettings                chan string                 // Names of bootstrap values received from retained MQTT state
+	startupRestore                  map[string]string           // "restored" or "default" per bootstrap value after the startup wait
+	retainedStates                  map[string]bool             // Entities whose retained state arrived during the startup wait
+	signedSentinels                 []uint32                    // "Not available" raw values for S32 registers
+	unsignedSentinels               []uint32                    // "Not available" raw values for U32 registers
+	modbusSlaveID                   int                         // Modbus unit ID of the inverter
+	modbusMode                      string                      // "tcp" or "rtu"
+	serialDevice                    string                      // Serial device for RTU mode
+	serialBaudRate                  int
+	serialDataBits                  int
+	serialParity                    string // "N", "E" or "O"
+	serialStopBits                  int
+	batchReads                      bool             // Read contiguous registers with one request
+	batchGapWords                   int              // Maximum unread gap (words) bridged within a batch
+	publishPhasePower               bool             // Poll and publish per-phase AC power
+	publishEnergyCounters           bool             // Poll and publish the inverter energy counters
+	registerMapFile                 string           // Register map file the polled registers were loaded from ("" = built-in)
+	builtinRegisterNames            map[string]bool  // Registers with built-in discovery
+	socUnknownWarned                bool             // SOC-unavailable warning already logged
+	socHysteresis                   int              // SOC drop (%) below maximumSoc before charging resumes
+	socCeilingReached               bool             // SOC ceiling latched until the SOC drops by socHysteresis
+	peakShaveLimitW                 int              // Grid import cap (W) for Peak Shaving
+	scheduleWindows                 []scheduleWindow // Time-of-use windows for Schedule
+	scheduleLocation                *time.Location   // Time zone the schedule windows are evaluated in
+	lastScheduleWindow              int              // Index of the schedule window applied last (-1 = none)
+	mqttMaxReconnectIntervalSeconds int              // Upper limit of the MQTT reconnect backoff
+	mqttSubscriptionsReady          bool             // Command topics are (re)subscribed on connect once startup is done
+	discoveryPrefix                 string           // Home Assistant MQTT discovery prefix
+	statusTopic                     string           // Availability topic (will, birth and discovery availability)
+	healthMaxPollAgeSeconds         int              // Poll age (s) after which /healthz reports unhealthy
+	modbusRecoveryMaxAttempts       int              // Reconnect attempts before releasing control and exiting (0 = unlimited)
+	modbusLastError                 error            // Last Modbus read/write error, reported when reconnecting
+	modbusBackoffMaxSeconds         int              // Upper limit of the Modbus reconnect backoff
+	modbusBackoff                   time.Duration    // Next Modbus reconnect delay, reset after a successful reconnect
+	writeReadbackVerify             bool             // Read the control registers back after each write
+	writeReadbackRetries            int              // Rewrites after a read-back mismatch
+	lastCommandConfirmed            bool             // Read-back of the last control write matched
+	publishSelfSufficiency          bool             // Publish the derived self_sufficiency sensor
+	balancedIntervalSeconds         int              // Fast poll interval (s) while Overwrite is Balanced
+	readbackPending                 *readbackRequest // Read-back waiting for the read loop (guarded by controlMu)
+	readbackSignal                  chan struct{}    // Wakes the read loop when readbackPending is set
+	pollSignal                      chan struct{}    // Asks the read loop for an extra poll (e.g. after a raw write)
+	commandSeq                      int64            // Request id of the last MQTT command (guarded by controlMu)
+	dryRun                          bool             // Log control commands instead of writing them
+	minWriteIntervalMs              int              // Minimum time between writes of an unchanged control command (0 disables)
+	minWriteDeltaW                  int              // Power command change that counts as a new command for minWriteIntervalMs
+	lastWriteAt                     time.Time        // Time of the last successful control write
+	rawAttributes                   bool             // Publish the raw register value of each polled sensor as JSON attributes
+	overwriteTimeoutMinutes         int              // Reset Overwrite to Off after this long without a command (0 disables)
+	pauseReleaseExportW             int              // Feed-in (W) above which Pause (charge ok) releases control to allow charging
+	pauseHoldExportW                int              // Feed-in (W) at or below which Pause (charge ok) holds the battery again
+	pauseMinDwellSeconds            int              // Minimum time between Pause (charge ok) hold/release changes
+	pauseToggledAt                  time.Time        // Last Pause (charge ok) hold/release change
+	zeroExportFull                  bool             // Zero Export released control because the SOC ceiling is reached
+	zeroExportLimitRegister         uint16           // Active power limit register (W) for Zero Export curtailment (0 disables)
+	pvLimitW                        int              // Active power limit written for Zero Export (-1 = not curtailed)
+	mqttQos                         byte             // QoS for subscriptions and retained publishes; telemetry uses 0
+	initialSettingsTimeoutMs        int              // Maximum startup wait for the retained bootstrap values
+	controlRegister                 uint16           // Communication control register (SMA 40151)
+	powerRegister                   uint16           // Active power command register (SMA 40149)
+	controlOn                       uint32           // Control register value that enables external control (SMA 802)
+	controlOff                      uint32           // Control register value that returns control to the inverter (SMA 803)
+	polledRegisters                 []regDef         // Registers polled each cycle (built-in, REGISTER_MAP_FILE and optional groups)
 
 	// Synchronization primitives to prevent Modbus command interference
 	modbusMu  sync.Mutex
 	controlMu sync.Mutex
+	// gridMu guards the polled control inputs (grid, battery, AC/DC power, SOC, netGrid), which are
+	// written by the poll and read by control logic that may run on the MQTT handler goroutine
+	gridMu sync.RWMutex
+	// sensorCacheMu guards lastSensorValues and sensorAvailable
+	sensorCacheMu sync.Mutex
+	// readErrorsMu guards recentReadErrors for the Balanced backoff
+	readErrorsMu sync.Mutex
+	// statusMu guards the connection status read by /healthz and the metrics from the HTTP goroutines:
+	// lastSuccessfulPoll, mqttConnected, mqttDisconnectedAt and modbusClientErrorTime
+	statusMu sync.Mutex
 
 	// Cached topic prefixes
 	sensorTopicPrefix      string
@@ -59,692 +369,4064 @@ var (
 
 	// Cache of last published sensor values to avoid redundant publishes
 	lastSensorValues map[string]string
+
+	// Energy integration state for energyOutput == "energy". energyMu (which also guards the battery
+	// totals) makes each sample update (previous sample, total, new sample) atomic so a sample cannot
+	// be integrated twice
+	energyMu          sync.Mutex
+	energyTotals      map[string]float64 // kWh since start
+	energyLastSamples map[string]powerSample
+}
+
+var (
+	controllers []*Controller // One per configured inverter
+
+	logLevel           = new(slog.LevelVar) // Minimum level logged, from LOG_LEVEL or the Debug Logging switch
+	configuredLogLevel slog.Level           // Level from the configuration, restored when Debug Logging is switched off
+	metricsPort        int                  // Port of the Prometheus /metrics endpoint (0 disables it)
+	healthPort         int                  // Port of the /healthz endpoint (0 disables it)
+)
+
+// Build information, set with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
 )
 
 func main() {
-	modbusClientErrorCount = 0
-	modbusClientErrorTime = time.Now()
+	inverters := loadGlobalConfig()
+	logInfof("SMA Battery Controller %s (commit %s, built %s, %s)", version, commit, buildDate, runtime.Version())
+
+	// Load the configuration of every inverter before connecting anything
+	deviceIDs := make(map[string]bool, len(inverters))
+	for _, env := range inverters {
+		c := newController(env, len(inverters) > 1)
+		if deviceIDs[c.deviceID] {
+			logFatalf("Duplicate DEVICE_ID %q in INVERTERS, each inverter needs its own", c.deviceID)
+		}
+		deviceIDs[c.deviceID] = true
+		controllers = append(controllers, c)
+	}
+
+	for _, c := range controllers {
+		c.start()
+	}
+
+	if metricsPort > 0 || healthPort > 0 {
+		startHTTPServers()
+	}
+
+	// Keep the application running until stopped, then release the inverters
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	logInfof("Received %v, shutting down", sig)
+	shutdownAll()
+}
+
+// loadGlobalConfig sets up logging, reads the HTTP ports and returns the option overrides of each
+// inverter from INVERTERS. Without INVERTERS there is one inverter configured by the environment alone.
+func loadGlobalConfig() []map[string]string {
+	// Logging first, so configuration problems below are reported in the chosen format.
+	// Without LOG_LEVEL, DEBUG_ENABLED selects debug or info as before.
+	level := strings.ToLower(getEnv("LOG_LEVEL", ""))
+	if level == "" {
+		level = "info"
+		if debug, err := strconv.ParseBool(getEnv("DEBUG_ENABLED", "true")); err != nil || debug {
+			level = "debug"
+		}
+	}
+	setupLogging(level, strings.ToLower(getEnv("LOG_FORMAT", "text")))
+
+	var err error
+	metricsPort, err = strconv.Atoi(getEnv("METRICS_PORT", "0"))
+	if err != nil || metricsPort < 0 || metricsPort > 65535 {
+		metricsPort = 0
+	}
+	healthPort, err = strconv.Atoi(getEnv("HEALTH_PORT", "0"))
+	if err != nil || healthPort < 0 || healthPort > 65535 {
+		healthPort = 0
+	}
+
+	value := strings.TrimSpace(getEnv("INVERTERS", ""))
+	if value == "" || value == "[]" {
+		return []map[string]string{nil}
+	}
+	inverters, err := parseInverters(value)
+	if err != nil {
+		logFatalf("Invalid INVERTERS: %v", err)
+	}
+	return inverters
+}
+
+// parseInverters parses the INVERTERS JSON list. Each entry maps option names (environment variable
+// names, case-insensitive) to the values that differ from the shared configuration, e.g.
+// [{"device_id": "sma_east", "sma_inverter_modbus_address": "192.168.1.100"}, ...]
+func parseInverters(value string) ([]map[string]string, error) {
+	var entries []map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &entries); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no inverters")
+	}
+	inverters := make([]map[string]string, 0, len(entries))
+	for i, entry := range entries {
+		env := make(map[string]string, len(entry))
+		for key, v := range entry {
+			switch v := v.(type) {
+			case string:
+				env[strings.ToUpper(key)] = v
+			case float64:
+				env[strings.ToUpper(key)] = strconv.FormatFloat(v, 'f', -1, 64)
+			case bool:
+				env[strings.ToUpper(key)] = strconv.FormatBool(v)
+			default:
+				return nil, fmt.Errorf("inverter %d: %s must be a string, number or boolean", i+1, key)
+			}
+		}
+		if env["DEVICE_ID"] == "" {
+			return nil, fmt.Errorf("inverter %d: device_id is required", i+1)
+		}
+		inverters = append(inverters, env)
+	}
+	return inverters, nil
+}
 
-	// Load environment variables
-	loadConfig()
+// newController loads the configuration of one inverter; env overrides the environment options
+func newController(env map[string]string, logDevice bool) *Controller {
+	c := &Controller{env: env, logDevice: logDevice}
+	c.readbackSignal = make(chan struct{}, 1)
+	c.pollSignal = make(chan struct{}, 1)
+	c.modbusClientErrorTime = time.Now()
+	c.loadConfig()
+	return c
+}
 
+// start connects MQTT and Modbus, publishes discovery and starts the read loop
+func (c *Controller) start() {
 	// Set up MQTT client
-	setupMQTT()
+	c.setupMQTT()
 
 	// Load initial settings from MQTT
-	loadInitialSettings()
+	c.loadInitialSettings()
 
 	// Publish MQTT discovery messages
-	publishDiscoveryMessages()
+	c.publishDiscoveryMessages()
+	c.lastDiscoveryPublish = time.Now()
+
+	if c.publishRegisterMapEnabled {
+		c.publishRegisterMap()
+	}
+
+	if c.publishStartupRestore {
+		c.publishStartupRestoreState()
+	}
+
+	c.publishBuildInfo()
 
 	// Set up Modbus client
-	setupModbus()
+	if err := c.setupModbus(); err != nil {
+		c.logFatalf("Modbus connection error: %v", err)
+	}
 
 	// Start Modbus reading loop
-	go modbusReadLoop()
+	go c.modbusReadLoop()
+	if len(c.scheduleWindows) > 0 {
+		go c.scheduleLoop()
+	}
 
-	// Listen for MQTT messages
-	listenTopic := fmt.Sprintf("homeassistant/+/%s/+/set", deviceID)
-	token := mqttClient.Subscribe(listenTopic, 0, mqttMessageHandler)
-	token.Wait()
-	if debugEnabled {
-		log.Printf("Subscribed to: %s", listenTopic)
+	// Listen for MQTT messages; OnConnect subscribes again after every reconnect from here on
+	c.mqttSubscriptionsReady = true
+	c.subscribeCommandTopics(c.mqttClient)
+}
+
+// shutdownAll releases every inverter; see shutdown
+func shutdownAll() {
+	for _, c := range controllers {
+		c.shutdown()
+	}
+}
+
+// Prometheus metrics, served on /metrics when METRICS_PORT is set; device_id is the inverter's DEVICE_ID
+var (
+	metricReadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sma_modbus_read_duration_seconds",
+		Help:    "Duration of the Modbus register reads of one poll.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"device_id"})
+	metricReadErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sma_modbus_read_errors_total",
+		Help: "Failed Modbus register reads.",
+	}, []string{"device_id"})
+	metricWriteErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sma_modbus_write_errors_total",
+		Help: "Failed Modbus register writes.",
+	}, []string{"device_id"})
+	metricMode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sma_control_mode",
+		Help: "Active control mode (1 for the current mode).",
+	}, []string{"device_id", "mode"})
+)
+
+// registerMetrics registers the metrics with the default Prometheus registry
+func registerMetrics() {
+	prometheus.MustRegister(metricReadDuration, metricReadErrors, metricWriteErrors, metricMode)
+	for _, c := range controllers {
+		c := c
+		metricMode.WithLabelValues(c.deviceID, c.currentLogicSelection).Set(1)
+		labels := prometheus.Labels{"device_id": c.deviceID}
+		prometheus.MustRegister(
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "sma_modbus_error_count",
+				Help:        "Current Modbus error count (reset after a quiet period).",
+				ConstLabels: labels,
+			}, func() float64 { return float64(c.modbusClientErrorCount.Load()) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "sma_last_successful_poll_timestamp_seconds",
+				Help:        "Unix time of the last poll without read errors.",
+				ConstLabels: labels,
+			}, func() float64 { return float64(c.lastPoll().Unix()) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "sma_battery_control_watts",
+				Help:        "Current battery_control setpoint.",
+				ConstLabels: labels,
+			}, func() float64 { return float64(c.batteryControlSetpoint()) }),
+		)
+	}
+}
+
+// startHTTPServers serves /metrics on metricsPort and /healthz on healthPort in the background;
+// both share one server when the ports are equal
+func startHTTPServers() {
+	muxes := make(map[int]*http.ServeMux)
+	muxFor := func(port int) *http.ServeMux {
+		if muxes[port] == nil {
+			muxes[port] = http.NewServeMux()
+		}
+		return muxes[port]
+	}
+	if metricsPort > 0 {
+		registerMetrics()
+		muxFor(metricsPort).Handle("/metrics", promhttp.Handler())
+		logInfof("Serving Prometheus metrics on :%d/metrics", metricsPort)
+	}
+	if healthPort > 0 {
+		muxFor(healthPort).HandleFunc("/healthz", healthHandler)
+		logInfof("Serving health check on :%d/healthz", healthPort)
+	}
+	for port, mux := range muxes {
+		go func(addr string, mux *http.ServeMux) {
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				logErrorf("HTTP server on %s stopped: %v", addr, err)
+			}
+		}(fmt.Sprintf(":%d", port), mux)
+	}
+}
+
+// healthHandler answers 200 while every inverter is healthy, 503 otherwise. With one inverter the
+// payload is its health; with several, "inverters" holds the health per device ID.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	allHealthy := true
+	var payload map[string]interface{}
+	inverters := make(map[string]interface{}, len(controllers))
+	for _, c := range controllers {
+		healthy, health := c.health()
+		allHealthy = allHealthy && healthy
+		inverters[c.deviceID] = health
+		payload = health
+	}
+	code := http.StatusOK
+	status := "ok"
+	if !allHealthy {
+		status = "unhealthy"
+		code = http.StatusServiceUnavailable
+	}
+	if len(controllers) > 1 {
+		payload = map[string]interface{}{"status": status, "inverters": inverters}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(payload)
+}
+
+// health reports whether the last successful poll is at most healthMaxPollAgeSeconds old and MQTT
+// is connected, together with the /healthz details
+func (c *Controller) health() (bool, map[string]interface{}) {
+	c.statusMu.Lock()
+	lastPoll, mqttConnected := c.lastSuccessfulPoll, c.mqttConnected
+	c.statusMu.Unlock()
+	pollAge := time.Since(lastPoll)
+	healthy := pollAge <= time.Duration(c.healthMaxPollAgeSeconds)*time.Second && mqttConnected
+	status := "ok"
+	if !healthy {
+		status = "unhealthy"
+	}
+	return healthy, map[string]interface{}{
+		"status":             status,
+		"last_poll":          lastPoll.Format(time.RFC3339),
+		"last_poll_age_s":    int(pollAge.Seconds()),
+		"modbus_error_count": c.modbusClientErrorCount.Load(),
+		"mqtt_connected":     mqttConnected,
+	}
+}
+
+// lastPoll returns the time of the last poll without read errors
+func (c *Controller) lastPoll() time.Time {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	return c.lastSuccessfulPoll
+}
+
+// batteryControlSetpoint returns the current battery_control
+func (c *Controller) batteryControlSetpoint() int {
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	return c.batteryControl
+}
+
+// overwriteSelection returns the Overwrite Logic Selection
+func (c *Controller) overwriteSelection() string {
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	return c.overwriteLogicSelection
+}
+
+// subscribeCommandTopics subscribes to the command topics and the Home Assistant status topic.
+// With a clean session the broker forgets subscriptions on disconnect, so this runs on every connect.
+func (c *Controller) subscribeCommandTopics(client mqtt.Client) {
+	listenTopic := fmt.Sprintf("%s/+/%s/+/set", c.discoveryPrefix, c.deviceID)
+	token := client.Subscribe(listenTopic, c.mqttQos, c.mqttMessageHandler)
+	if token.Wait() && token.Error() != nil {
+		c.logErrorf("Error subscribing to %s: %v", listenTopic, token.Error())
+	} else {
+		c.logDebugf("Subscribed to: %s", listenTopic)
+	}
+
+	// Republish discovery when Home Assistant comes back online
+	token = client.Subscribe(c.discoveryPrefix+"/status", c.mqttQos, func(client mqtt.Client, msg mqtt.Message) {
+		if string(msg.Payload()) == "online" {
+			c.republishDiscovery()
+		}
+	})
+	if token.Wait() && token.Error() != nil {
+		c.logErrorf("Error subscribing to %s/status: %v", c.discoveryPrefix, token.Error())
+	}
+}
+
+// shutdown returns the inverter to internal control (controlOff, power command 0, no PV curtailment;
+// skipped in dry run), publishes the offline status and closes MQTT and Modbus. Errors are only logged; there is
+// no retry on exit.
+func (c *Controller) shutdown() {
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	c.modbusMu.Lock()
+	if !c.dryRun {
+		writes := []regWrite{{c.controlRegister, uint32ToBytes(c.controlOff)}, {c.powerRegister, int32ToBytes(0)}}
+		if c.pvLimitW >= 0 {
+			// Lift the Zero Export curtailment
+			writes = append(writes, regWrite{c.zeroExportLimitRegister, uint32ToBytes(uint32(c.inverterAcLimitW))})
+		}
+		for _, w := range writes {
+			if _, err := c.modbusClient.WriteMultipleRegisters(w.addr, 2, w.data); err != nil {
+				c.logErrorf("Error releasing control (register %d): %v", w.addr, err)
+			}
+		}
+	}
+	if c.modbusHandler != nil {
+		c.modbusHandler.Close()
+	}
+	c.modbusMu.Unlock()
+	if !c.dryRun {
+		c.logInfof("Battery control released")
 	}
 
-	// Keep the application running
-	select {}
+	token := c.mqttClient.Publish(c.statusTopic, c.mqttQos, true, "offline")
+	token.WaitTimeout(2 * time.Second)
+	c.mqttClient.Disconnect(250)
 }
 
-func loadConfig() {
+func (c *Controller) loadConfig() {
 	// Load and parse environment variables
 	var err error
 
-	maximumBatteryControl, err = strconv.Atoi(getEnv("MAXIMUM_BATTERY_CONTROL", "6000"))
+	// Device ID first, so the log messages below can be tagged with it
+	c.deviceID = c.getEnv("DEVICE_ID", "sma_battery_controller")
+
+	c.maximumBatteryControl, err = strconv.Atoi(c.getEnv("MAXIMUM_BATTERY_CONTROL", "6000"))
+	if err != nil {
+		c.logFatalf("Invalid MAXIMUM_BATTERY_CONTROL: %v", err)
+	}
+
+	c.modbusIntervalInSeconds, err = strconv.Atoi(c.getEnv("MODBUS_INTERVAL_IN_SECONDS", "5"))
 	if err != nil {
-		log.Fatalf("Invalid MAXIMUM_BATTERY_CONTROL: %v", err)
+		c.logFatalf("Invalid MODBUS_INTERVAL_IN_SECONDS: %v", err)
+	}
+
+	c.resetIntervalMinutes, err = strconv.Atoi(c.getEnv("RESET_INTERVAL_MINUTES", "5"))
+	if err != nil || c.resetIntervalMinutes <= 0 {
+		c.resetIntervalMinutes = 5
 	}
 
-	modbusIntervalInSeconds, err = strconv.Atoi(getEnv("MODBUS_INTERVAL_IN_SECONDS", "5"))
+	// Post-command stabilization delay (ms)
+	c.postCommandDelayMs, err = strconv.Atoi(c.getEnv("POST_COMMAND_DELAY_MS", "1600"))
+	if err != nil || c.postCommandDelayMs < 0 {
+		c.postCommandDelayMs = 1600
+	}
+	c.writeReadbackVerify, err = strconv.ParseBool(c.getEnv("WRITE_READBACK_VERIFY", "false"))
 	if err != nil {
-		log.Fatalf("Invalid MODBUS_INTERVAL_IN_SECONDS: %v", err)
+		c.writeReadbackVerify = false
+	}
+	c.writeReadbackRetries, err = strconv.Atoi(c.getEnv("WRITE_READBACK_RETRIES", "2"))
+	if err != nil || c.writeReadbackRetries < 0 {
+		c.writeReadbackRetries = 2
 	}
 
-	debugEnabled, err = strconv.ParseBool(getEnv("DEBUG_ENABLED", "true"))
+	// Dry run: control commands are only logged; sensors are still read and published
+	c.dryRun, err = strconv.ParseBool(c.getEnv("DRY_RUN", "false"))
 	if err != nil {
-		debugEnabled = true
+		c.dryRun = false
+	}
+	if c.dryRun {
+		c.logWarnf("DRY_RUN is enabled. Control commands are logged but not written to the inverter.")
+		// Nothing is written, so there is nothing to read back
+		c.writeReadbackVerify = false
 	}
 
-	resetIntervalMinutes, err = strconv.Atoi(getEnv("RESET_INTERVAL_MINUTES", "5"))
-	if err != nil || resetIntervalMinutes <= 0 {
-		resetIntervalMinutes = 5
+	// Control register layout; the defaults are the SMA Sunny Tripower SE registers and codes
+	controlRegister, err := strconv.ParseUint(c.getEnv("CONTROL_REGISTER", "40151"), 10, 16)
+	if err != nil || controlRegister == 0 {
+		c.logWarnf("Invalid CONTROL_REGISTER, using 40151")
+		controlRegister = 40151
 	}
+	c.controlRegister = uint16(controlRegister)
+	powerRegister, err := strconv.ParseUint(c.getEnv("POWER_REGISTER", "40149"), 10, 16)
+	if err != nil || powerRegister == 0 || powerRegister == controlRegister {
+		c.logWarnf("Invalid POWER_REGISTER, using 40149")
+		powerRegister = 40149
+	}
+	c.powerRegister = uint16(powerRegister)
+	controlOn, err := strconv.ParseUint(c.getEnv("CONTROL_ON_CODE", "802"), 10, 32)
+	if err != nil {
+		c.logWarnf("Invalid CONTROL_ON_CODE, using 802")
+		controlOn = 802
+	}
+	controlOff, err := strconv.ParseUint(c.getEnv("CONTROL_OFF_CODE", "803"), 10, 32)
+	if err != nil || controlOff == controlOn {
+		c.logWarnf("Invalid CONTROL_OFF_CODE, using 803")
+		controlOff = 803
+	}
+	c.controlOn = uint32(controlOn)
+	c.controlOff = uint32(controlOff)
 
-	// Post-command stabilization delay (ms)
-	postCommandDelayMs, err = strconv.Atoi(getEnv("POST_COMMAND_DELAY_MS", "1600"))
-	if err != nil || postCommandDelayMs < 0 {
-		postCommandDelayMs = 1600
+	c.minWriteIntervalMs, err = strconv.Atoi(c.getEnv("MIN_WRITE_INTERVAL_MS", "0"))
+	if err != nil || c.minWriteIntervalMs < 0 {
+		c.minWriteIntervalMs = 0
+	}
+	c.minWriteDeltaW, err = strconv.Atoi(c.getEnv("MIN_WRITE_DELTA_W", "50"))
+	if err != nil || c.minWriteDeltaW < 0 {
+		c.minWriteDeltaW = 50
 	}
 
-	deviceID = getEnv("DEVICE_ID", "sma_battery_controller")
+	// Order of the two control writes; some firmware wants the power value before control is enabled
+	c.writeOrder = strings.ToLower(c.getEnv("WRITE_ORDER", "control_first"))
+	if c.writeOrder != "control_first" && c.writeOrder != "power_first" {
+		c.logWarnf("Invalid WRITE_ORDER %q, using control_first", c.writeOrder)
+		c.writeOrder = "control_first"
+	}
 
-	// Initialize control variables
-	automaticLogicSelection = "Automatic"
-	overwriteLogicSelection = "Off"
-	currentLogicSelection = "Automatic"
-	lastValidBatteryControl = 0
-	previousMode = ""
-	lastChangeTime = time.Now()
+	c.retainState, err = strconv.ParseBool(c.getEnv("RETAIN_STATE", "false"))
+	if err != nil {
+		c.retainState = false
+	}
 
-	// Precompute topic prefixes and initialize caches
-	sensorTopicPrefix = "homeassistant/sensor/" + deviceID + "/"
-	selectStateTopicPrefix = "homeassistant/select/" + deviceID + "/"
-	numberStateTopicPrefix = "homeassistant/number/" + deviceID + "/"
-	lastSensorValues = make(map[string]string, 24)
-}
+	c.modeButtonsEnabled, err = strconv.ParseBool(c.getEnv("MODE_BUTTONS", "false"))
+	if err != nil {
+		c.modeButtonsEnabled = false
+	}
 
-func setupMQTT() {
-	// Set up MQTT options
-	opts := mqtt.NewClientOptions()
-	mqttServerAddress := getEnv("MQTT_SERVER_ADDRESS", "127.0.0.1")
-	mqttServerPort := getEnv("MQTT_SERVER_PORT", "1883")
-	brokerURL := fmt.Sprintf("tcp://%s:%s", mqttServerAddress, mqttServerPort)
-	opts.AddBroker(brokerURL)
-	mqttUser := getEnv("MQTT_USER", "")
-	mqttPassword := getEnv("MQTT_PASSWORD", "")
-	if mqttUser != "" {
-		opts.Username = mqttUser
-		opts.Password = mqttPassword
+	c.modbusReconnectEachPoll, err = strconv.ParseBool(c.getEnv("MODBUS_RECONNECT_EACH_POLL", "false"))
+	if err != nil {
+		c.modbusReconnectEachPoll = false
 	}
-	opts.SetClientID(deviceID)
 
-	// Set Last Will and Testament (LWT)
-	willTopic := "smastp_modbus/status"
-	willPayload := "offline"
-	opts.SetWill(willTopic, willPayload, 0, true)
+	c.pollJitterPercent, err = strconv.Atoi(c.getEnv("POLL_JITTER_PERCENT", "0"))
+	if err != nil || c.pollJitterPercent < 0 || c.pollJitterPercent > 50 {
+		c.pollJitterPercent = 0
+	}
 
-	// Publish birth message after connection
-	opts.OnConnect = func(c mqtt.Client) {
-		birthTopic := "smastp_modbus/status"
-		birthPayload := "online"
-		token := c.Publish(birthTopic, 0, true, birthPayload)
-		token.Wait()
-		if debugEnabled {
-			log.Println("Published birth message to", birthTopic)
+	c.powerFlowTopic = c.getEnv("POWER_FLOW_TOPIC", "")
+
+	// SOC limits
+	c.minimumSoc, err = strconv.Atoi(c.getEnv("MINIMUM_SOC", "0"))
+	if err != nil || c.minimumSoc < 0 || c.minimumSoc > 100 {
+		c.minimumSoc = 0
+	}
+	c.maximumSoc, err = strconv.Atoi(c.getEnv("MAXIMUM_SOC", "100"))
+	if err != nil || c.maximumSoc < c.minimumSoc || c.maximumSoc > 100 {
+		c.maximumSoc = 100
+	}
+	c.socHysteresis, err = strconv.Atoi(c.getEnv("SOC_HYSTERESIS", "5"))
+	if err != nil || c.socHysteresis < 0 || c.socHysteresis > 100 {
+		c.socHysteresis = 5
+	}
+	c.validateControlSoc, err = strconv.ParseBool(c.getEnv("VALIDATE_BATTERY_CONTROL_SOC", "false"))
+	if err != nil {
+		c.validateControlSoc = false
+	}
+
+	c.energyOutput = strings.ToLower(c.getEnv("ENERGY_OUTPUT", "none"))
+	if c.energyOutput != "none" && c.energyOutput != "measurement" && c.energyOutput != "energy" {
+		c.logWarnf("Invalid ENERGY_OUTPUT %q, using none", c.energyOutput)
+		c.energyOutput = "none"
+	}
+
+	c.readWatchdogSeconds, err = strconv.Atoi(c.getEnv("READ_WATCHDOG_SECONDS", "0"))
+	if err != nil || c.readWatchdogSeconds < 0 {
+		c.readWatchdogSeconds = 0
+	}
+	c.readWatchdogMaxRestarts, err = strconv.Atoi(c.getEnv("READ_WATCHDOG_MAX_RESTARTS", "0"))
+	if err != nil || c.readWatchdogMaxRestarts < 0 {
+		c.readWatchdogMaxRestarts = 0
+	}
+
+	// Proportional correction factors for power registers, e.g. GRID_DRAW_CORRECTION=1.03
+	c.powerCorrections = make(map[string]float64)
+	for name := range powerSensors {
+		key := strings.ToUpper(name) + "_CORRECTION"
+		factor, err := strconv.ParseFloat(c.getEnv(key, "1.0"), 64)
+		if err != nil || factor <= 0 {
+			c.logWarnf("Invalid %s, using 1.0", key)
+			continue
+		}
+		if factor != 1.0 {
+			c.powerCorrections[name] = factor
+			c.logInfof("Applying correction factor %.4f to %s", factor, name)
 		}
 	}
 
-	// Create and start MQTT client
-	mqttClient = mqtt.NewClient(opts)
-	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatalf("MQTT connection error: %v", token.Error())
+	c.zeroControlPolicy = strings.ToLower(c.getEnv("ZERO_CONTROL_POLICY", "legacy"))
+	if c.zeroControlPolicy != "legacy" && c.zeroControlPolicy != "release" && c.zeroControlPolicy != "hold" {
+		c.logWarnf("Invalid ZERO_CONTROL_POLICY %q, using legacy", c.zeroControlPolicy)
+		c.zeroControlPolicy = "legacy"
 	}
-}
 
-func publishDiscoveryMessages() {
-	// Device information
-	deviceInfo := map[string]interface{}{
-		"identifiers":  []string{deviceID},
-		"manufacturer": "Custom",
-		"model":        "SMA Battery Controller",
-		"name":         "SMA Battery Controller",
+	c.balancedAlgorithm = strings.ToLower(c.getEnv("BALANCED_ALGORITHM", "legacy"))
+	if c.balancedAlgorithm != "legacy" && c.balancedAlgorithm != "proportional" {
+		c.logWarnf("Invalid BALANCED_ALGORITHM %q, using legacy", c.balancedAlgorithm)
+		c.balancedAlgorithm = "legacy"
+	}
+	c.balancedIntervalSeconds, err = strconv.Atoi(c.getEnv("BALANCED_INTERVAL_SECONDS", "1"))
+	if err != nil || c.balancedIntervalSeconds < 1 {
+		c.logWarnf("Invalid BALANCED_INTERVAL_SECONDS, using 1")
+		c.balancedIntervalSeconds = 1
+	}
+	c.balancedGain, err = strconv.ParseFloat(c.getEnv("BALANCED_GAIN", "1.0"), 64)
+	if err != nil || c.balancedGain <= 0 {
+		c.balancedGain = 1.0
+	}
+	c.balancedDeadbandW, err = strconv.Atoi(c.getEnv("BALANCED_DEADBAND_W", "30"))
+	if err != nil || c.balancedDeadbandW < 0 {
+		c.balancedDeadbandW = 30
 	}
 
-	// Always publish discovery for selects and number so HA can send commands
-	publishSelect("automatic_logic_selection", "Automatic Logic Selection", []string{"Automatic", "Balanced", "Pause (charge ok)", "Pause", "Charge Battery", "Discharge Battery"}, automaticLogicSelection, deviceInfo)
-	publishSelect("overwrite_logic_selection", "Overwrite Logic Selection", []string{"Off", "Automatic", "Balanced", "Pause (charge ok)", "Pause", "Charge Battery", "Discharge Battery"}, overwriteLogicSelection, deviceInfo)
-	// Make Current Logic Selection read-only by publishing as a sensor (no command topic)
-	publishSensor("current_logic_selection", "Current Logic Selection", "", deviceInfo)
-	// Remove old select-based Current Logic Selection entity by clearing its discovery and state
-	oldSelectConfigTopic := fmt.Sprintf("homeassistant/select/%s/current_logic_selection/config", deviceID)
-	mqttPublish(oldSelectConfigTopic, []byte(""), true)
-	oldSelectStateTopic := fmt.Sprintf("homeassistant/select/%s/current_logic_selection/state", deviceID)
-	mqttPublish(oldSelectStateTopic, []byte(""), true)
+	c.publishModbusUptime, err = strconv.ParseBool(c.getEnv("PUBLISH_MODBUS_UPTIME", "false"))
+	if err != nil {
+		c.publishModbusUptime = false
+	}
 
-	if batteryControl == 0 {
-		batteryControl = int(math.Round(float64(maximumBatteryControl) * 0.90)) // 90% of max control
-		lastValidBatteryControl = batteryControl
+	c.softStartCycles, err = strconv.Atoi(c.getEnv("SOFT_START_CYCLES", "0"))
+	if err != nil || c.softStartCycles < 0 {
+		c.softStartCycles = 0
 	}
-	publishNumber("battery_control", "Battery Control", 0, float64(maximumBatteryControl), 100, float64(batteryControl), deviceInfo)
 
-	// Publish sensors regardless of initial state
-	publishSensor("battery_status", "Battery Status", "", deviceInfo)
-	publishSensor("battery_soc", "Battery State of Charge", "%", deviceInfo)
-	publishSensor("battery_temperature", "Battery Temperature", "°C", deviceInfo)
-	publishSensor("inverter_temperature", "Inverter Temperature", "°C", deviceInfo)
-	publishSensor("battery_diagnose_current_capacity", "Battery Health", "%", deviceInfo)
-	publishSensor("battery_charge_power", "Battery Charge Power", "W", deviceInfo)
-	publishSensor("battery_discharge_power", "Battery Discharge Power", "W", deviceInfo)
-	publishSensor("dc1_current", "DC1 Current", "A", deviceInfo)
-	publishSensor("dc1_voltage", "DC1 Voltage", "V", deviceInfo)
-	publishSensor("dc1_power", "DC1 Power", "W", deviceInfo)
-	publishSensor("dc2_current", "DC1 Current", "A", deviceInfo)
-	publishSensor("dc2_voltage", "DC1 Voltage", "V", deviceInfo)
-	publishSensor("dc2_power", "DC1 Power", "W", deviceInfo)
-	publishSensor("ac_power", "AC Power", "W", deviceInfo)
-	publishSensor("grid_feed", "Grid Feed Power", "W", deviceInfo)
-	publishSensor("grid_draw", "Grid Draw Power", "W", deviceInfo)
-	publishSensor("modbus_error_count", "Modbus Error Count", "", deviceInfo)
-}
-
-func publishSelect(objectID, name string, options []string, initial string, deviceInfo map[string]interface{}) {
-	configTopic := fmt.Sprintf("homeassistant/select/%s/%s/config", deviceID, objectID)
-	commandTopic := fmt.Sprintf("homeassistant/select/%s/%s/set", deviceID, objectID)
-	stateTopic := fmt.Sprintf("homeassistant/select/%s/%s/state", deviceID, objectID)
+	// Eco low-activity window, e.g. ECO_START=23:00 ECO_END=06:00
+	c.ecoStartMinute = -1
+	if ecoStart, ecoEnd := c.getEnv("ECO_START", ""), c.getEnv("ECO_END", ""); ecoStart != "" && ecoEnd != "" {
+		start, errStart := parseClock(ecoStart)
+		end, errEnd := parseClock(ecoEnd)
+		if errStart != nil || errEnd != nil || start == end {
+			c.logWarnf("Invalid ECO_START/ECO_END %q-%q, eco mode disabled", ecoStart, ecoEnd)
+		} else {
+			c.ecoStartMinute = start
+			c.ecoEndMinute = end
+		}
+	}
+	c.ecoIntervalSeconds, err = strconv.Atoi(c.getEnv("ECO_INTERVAL_SECONDS", "60"))
+	if err != nil || c.ecoIntervalSeconds < c.modbusIntervalInSeconds {
+		c.ecoIntervalSeconds = 60
+	}
+	c.ecoReleaseControl, err = strconv.ParseBool(c.getEnv("ECO_RELEASE_CONTROL", "true"))
+	if err != nil {
+		c.ecoReleaseControl = true
+	}
 
-	configPayload := map[string]interface{}{
-		"name":          name,
-		"command_topic": commandTopic,
-		"state_topic":   stateTopic,
-		"options":       options,
-		"unique_id":     fmt.Sprintf("%s_%s", deviceID, objectID),
-		"device":        deviceInfo,
-		"availability": []map[string]string{
-			{
-				"topic":       "smastp_modbus/status",
-				"payload_on":  "online",
-				"payload_off": "offline",
-			},
-		},
+	c.ackTopic = c.getEnv("ACK_TOPIC", "")
+
+	// Enum register decoding; BATTERY_STATUS_MAP entries ("305=Charging,...") override the defaults
+	c.enumTexts = make(map[string]map[int64]string)
+	// Off by default: switching an existing sensor from codes to text breaks automations comparing numbers
+	batteryStatusText, err := strconv.ParseBool(c.getEnv("BATTERY_STATUS_TEXT", "false"))
+	if err == nil && batteryStatusText {
+		texts := make(map[int64]string, len(defaultBatteryStatusTexts))
+		for code, text := range defaultBatteryStatusTexts {
+			texts[code] = text
+		}
+		overrides, err := parseEnumTexts(c.getEnv("BATTERY_STATUS_MAP", ""))
+		if err != nil {
+			c.logWarnf("Invalid BATTERY_STATUS_MAP, using defaults: %v", err)
+		}
+		for code, text := range overrides {
+			texts[code] = text
+		}
+		c.enumTexts["battery_status"] = texts
 	}
 
-	payloadBytes, _ := json.Marshal(configPayload)
-	mqttPublish(configTopic, payloadBytes, true)
+	c.publishStartupRestore, err = strconv.ParseBool(c.getEnv("PUBLISH_STARTUP_RESTORE", "false"))
+	if err != nil {
+		c.publishStartupRestore = false
+	}
+	c.restoredSettings = make(chan string, 8)
+	c.initialSettingsTimeoutMs, err = strconv.Atoi(c.getEnv("INITIAL_SETTINGS_TIMEOUT_MS", "2000"))
+	if err != nil || c.initialSettingsTimeoutMs < 0 {
+		c.initialSettingsTimeoutMs = 2000
+	}
+	c.startupRestore = make(map[string]string, 3)
 
-	// Publish initial state
-	mqttPublish(stateTopic, []byte(initial), true)
-}
+	c.balancedReturnSetpoint = strings.ToLower(c.getEnv("BALANCED_RETURN_SETPOINT", "hold"))
+	if c.balancedReturnSetpoint != "hold" && c.balancedReturnSetpoint != "restore" && c.balancedReturnSetpoint != "default" {
+		c.logWarnf("Invalid BALANCED_RETURN_SETPOINT %q, using hold", c.balancedReturnSetpoint)
+		c.balancedReturnSetpoint = "hold"
+	}
 
-func publishNumber(objectID, name string, min, max, step, initial float64, deviceInfo map[string]interface{}) {
-	configTopic := fmt.Sprintf("homeassistant/number/%s/%s/config", deviceID, objectID)
-	commandTopic := fmt.Sprintf("homeassistant/number/%s/%s/set", deviceID, objectID)
-	stateTopic := fmt.Sprintf("homeassistant/number/%s/%s/state", deviceID, objectID)
+	c.publishInverterEfficiency, err = strconv.ParseBool(c.getEnv("PUBLISH_INVERTER_EFFICIENCY", "false"))
+	if err != nil {
+		c.publishInverterEfficiency = false
+	}
+	c.efficiencyMinPowerW, err = strconv.Atoi(c.getEnv("EFFICIENCY_MIN_POWER_W", "500"))
+	if err != nil || c.efficiencyMinPowerW < 0 {
+		c.efficiencyMinPowerW = 500
+	}
 
-	configPayload := map[string]interface{}{
-		"name":                name,
-		"command_topic":       commandTopic,
-		"state_topic":         stateTopic,
-		"min":                 min,
-		"max":                 max,
-		"step":                step,
-		"unit_of_measurement": "W",
-		"unique_id":           fmt.Sprintf("%s_%s", deviceID, objectID),
-		"device":              deviceInfo,
-		"availability": []map[string]string{
-			{
-				"topic":       "smastp_modbus/status",
-				"payload_on":  "online",
-				"payload_off": "offline",
-			},
-		},
+	c.waitForFirstPoll, err = strconv.ParseBool(c.getEnv("WAIT_FOR_FIRST_POLL", "true"))
+	if err != nil {
+		c.waitForFirstPoll = true
 	}
 
-	payloadBytes, _ := json.Marshal(configPayload)
-	mqttPublish(configTopic, payloadBytes, true)
+	c.publishHouseLoad, err = strconv.ParseBool(c.getEnv("PUBLISH_HOUSE_LOAD", "false"))
+	if err != nil {
+		c.publishHouseLoad = false
+	}
+	c.publishSelfSufficiency, err = strconv.ParseBool(c.getEnv("PUBLISH_SELF_SUFFICIENCY", "false"))
+	if err != nil {
+		c.publishSelfSufficiency = false
+	}
 
-	// Publish initial state
-	mqttPublish(stateTopic, []byte(fmt.Sprintf("%.0f", initial)), true)
-}
+	c.heartbeatTopic = c.getEnv("HEARTBEAT_TOPIC", "")
 
-func publishSensor(objectID, name, unit string, deviceInfo map[string]interface{}) {
-	configTopic := fmt.Sprintf("homeassistant/sensor/%s/%s/config", deviceID, objectID)
-	stateTopic := fmt.Sprintf("homeassistant/sensor/%s/%s/state", deviceID, objectID)
+	c.gridSenseInvert, err = strconv.ParseBool(c.getEnv("GRID_SENSE_INVERT", "false"))
+	if err != nil {
+		c.gridSenseInvert = false
+	}
+	if c.gridSenseInvert {
+		c.logInfof("Grid sense inverted: register 30865 is used as grid_feed and 30867 as grid_draw")
+	} else {
+		c.logInfof("Grid sense normal: register 30865 is used as grid_draw and 30867 as grid_feed")
+	}
 
-	configPayload := map[string]interface{}{
-		"name":                name,
-		"state_topic":         stateTopic,
-		"unit_of_measurement": unit,
-		"value_template":      "{{ value }}",
-		"unique_id":           fmt.Sprintf("%s_%s", deviceID, objectID),
-		"device":              deviceInfo,
-		"availability": []map[string]string{
-			{
-				"topic":       "smastp_modbus/status",
-				"payload_on":  "online",
-				"payload_off": "offline",
-			},
+	// Battery charge/discharge energy totals, optionally persisted across restarts
+	c.batteryEnergyTotals, err = strconv.ParseBool(c.getEnv("BATTERY_ENERGY_TOTALS", "false"))
+	if err != nil {
+		c.batteryEnergyTotals = false
+	}
+	c.energyStateFile = c.getEnv("ENERGY_STATE_FILE", "")
+	c.batteryTotals = make(map[string]float64, len(batteryTotalSensors))
+	c.batteryTotalSamples = make(map[string]powerSample, len(batteryTotalSensors))
+	if c.batteryEnergyTotals && c.energyStateFile != "" {
+		c.loadBatteryTotals()
+	}
+
+	// Built-in register names have their own discovery; registers from the map file use their classes
+	c.builtinRegisterNames = make(map[string]bool)
+	for _, list := range [][]regDef{defaultPolledRegisters, phasePowerRegisters, energyCounterRegisters} {
+		for _, r := range list {
+			c.builtinRegisterNames[r.name] = true
+		}
+	}
+	c.polledRegisters = append([]regDef(nil), defaultPolledRegisters...)
+	c.registerMapFile = c.getEnv("REGISTER_MAP_FILE", "")
+	if c.registerMapFile != "" {
+		regs, err := loadRegisterMap(c.registerMapFile)
+		if err != nil {
+			c.logWarnf("Invalid REGISTER_MAP_FILE %s, using built-in registers: %v", c.registerMapFile, err)
+			c.registerMapFile = ""
+		} else {
+			c.polledRegisters = regs
+			names := make([]string, 0, len(regs))
+			for _, r := range regs {
+				names = append(names, fmt.Sprintf("%s@%d", r.name, r.addr))
+			}
+			c.logInfof("Loaded %d registers from %s: %s", len(regs), c.registerMapFile, strings.Join(names, ", "))
+		}
+	}
+
+	c.publishPhasePower, err = strconv.ParseBool(c.getEnv("PUBLISH_PHASE_POWER", "false"))
+	if err != nil {
+		c.publishPhasePower = false
+	}
+	c.publishEnergyCounters, err = strconv.ParseBool(c.getEnv("PUBLISH_ENERGY_COUNTERS", "false"))
+	if err != nil {
+		c.publishEnergyCounters = false
+	}
+	for _, optional := range []struct {
+		enabled bool
+		regs    []regDef
+	}{{c.publishPhasePower, phasePowerRegisters}, {c.publishEnergyCounters, energyCounterRegisters}} {
+		for _, r := range optional.regs {
+			if optional.enabled && !c.isPolledRegister(r.name) {
+				c.polledRegisters = append(c.polledRegisters, r)
+			}
+		}
+	}
+
+	// Polling groups: POLL_GROUP_INTERVALS sets seconds per group, REGISTER_POLL_GROUPS assigns registers
+	// ("battery_soc=slow,..."); unassigned registers are in "fast" and read every poll
+	c.pollGroupIntervals = map[string]int{"fast": 0, "medium": 10, "slow": 60}
+	for _, entry := range strings.Split(c.getEnv("POLL_GROUP_INTERVALS", ""), ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || seconds < 0 {
+			c.logWarnf("Invalid POLL_GROUP_INTERVALS entry %q, ignored", entry)
+			continue
+		}
+		c.pollGroupIntervals[strings.TrimSpace(parts[0])] = seconds
+	}
+	c.registerPollGroups = make(map[string]string, len(c.polledRegisters))
+	for _, r := range c.polledRegisters {
+		c.registerPollGroups[r.name] = "fast"
+	}
+	for _, entry := range strings.Split(c.getEnv("REGISTER_POLL_GROUPS", ""), ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name, group := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if _, ok := c.pollGroupIntervals[group]; !ok || !c.isPolledRegister(name) {
+			c.logWarnf("Invalid REGISTER_POLL_GROUPS entry %q, ignored", entry)
+			continue
+		}
+		c.registerPollGroups[name] = group
+	}
+	c.lastRegisterPoll = make(map[string]time.Time, len(c.polledRegisters))
+
+	// Modbus unit ID of the inverter (SMA default 3)
+	c.modbusSlaveID, err = strconv.Atoi(c.getEnv("MODBUS_SLAVE_ID", "3"))
+	if err != nil || c.modbusSlaveID < 1 || c.modbusSlaveID > 247 {
+		c.logFatalf("Invalid MODBUS_SLAVE_ID %q, must be 1-247", c.getEnv("MODBUS_SLAVE_ID", "3"))
+	}
+
+	// SMA "not available" values: 0x80000000 for S32, 0xFFFFFFFF (and 0xFFFFFFFD for enums) for U32
+	c.signedSentinels, err = parseSentinels(c.getEnv("SIGNED_SENTINELS", "0x80000000"))
+	if err != nil {
+		c.logWarnf("Invalid SIGNED_SENTINELS, using default: %v", err)
+		c.signedSentinels = []uint32{0x80000000}
+	}
+	c.unsignedSentinels, err = parseSentinels(c.getEnv("UNSIGNED_SENTINELS", "0xFFFFFFFF,0xFFFFFFFD"))
+	if err != nil {
+		c.logWarnf("Invalid UNSIGNED_SENTINELS, using default: %v", err)
+		c.unsignedSentinels = []uint32{0xFFFFFFFF, 0xFFFFFFFD}
+	}
+
+	// Optional sanity bounds on scaled register values ("battery_soc=0:100,...")
+	c.sensorBounds, err = parseSensorBounds(c.getEnv("SENSOR_BOUNDS", ""))
+	if err != nil {
+		c.logWarnf("Invalid SENSOR_BOUNDS, bounds disabled: %v", err)
+		c.sensorBounds = map[string]valueBounds{}
+	}
+	c.sensorBoundsAction = strings.ToLower(c.getEnv("SENSOR_BOUNDS_ACTION", "drop"))
+	if c.sensorBoundsAction != "drop" && c.sensorBoundsAction != "unavailable" {
+		c.logWarnf("Invalid SENSOR_BOUNDS_ACTION %q, using drop", c.sensorBoundsAction)
+		c.sensorBoundsAction = "drop"
+	}
+
+	c.publishPollCounters, err = strconv.ParseBool(c.getEnv("PUBLISH_POLL_COUNTERS", "false"))
+	if err != nil {
+		c.publishPollCounters = false
+	}
+
+	c.rawAttributes, err = strconv.ParseBool(c.getEnv("RAW_ATTRIBUTES", "false"))
+	if err != nil {
+		c.rawAttributes = false
+	}
+
+	// Batch contiguous register reads into one request; MODBUS_BATCH_GAP_WORDS allows unread gaps
+	c.batchReads, err = strconv.ParseBool(c.getEnv("MODBUS_BATCH_READS", "true"))
+	if err != nil {
+		c.batchReads = true
+	}
+	c.batchGapWords, err = strconv.Atoi(c.getEnv("MODBUS_BATCH_GAP_WORDS", "0"))
+	if err != nil || c.batchGapWords < 0 {
+		c.batchGapWords = 0
+	}
+
+	// Modbus transport: "tcp" (default) or "rtu" over a serial RS485 adapter
+	c.modbusMode = strings.ToLower(c.getEnv("MODBUS_MODE", "tcp"))
+	if c.modbusMode != "tcp" && c.modbusMode != "rtu" {
+		c.logFatalf("Invalid MODBUS_MODE %q, must be tcp or rtu", c.modbusMode)
+	}
+	c.serialDevice = c.getEnv("MODBUS_SERIAL_DEVICE", "/dev/ttyUSB0")
+	c.serialBaudRate, err = strconv.Atoi(c.getEnv("MODBUS_BAUD_RATE", "19200"))
+	if err != nil || c.serialBaudRate <= 0 {
+		c.serialBaudRate = 19200
+	}
+	c.serialDataBits, err = strconv.Atoi(c.getEnv("MODBUS_DATA_BITS", "8"))
+	if err != nil || c.serialDataBits < 5 || c.serialDataBits > 8 {
+		c.serialDataBits = 8
+	}
+	c.serialParity = strings.ToUpper(c.getEnv("MODBUS_PARITY", "E"))
+	if c.serialParity != "N" && c.serialParity != "E" && c.serialParity != "O" {
+		c.logWarnf("Invalid MODBUS_PARITY %q, using E", c.serialParity)
+		c.serialParity = "E"
+	}
+	c.serialStopBits, err = strconv.Atoi(c.getEnv("MODBUS_STOP_BITS", "1"))
+	if err != nil || (c.serialStopBits != 1 && c.serialStopBits != 2) {
+		c.serialStopBits = 1
+	}
+
+	c.inverterAddress = c.getEnv("SMA_INVERTER_MODBUS_ADDRESS", "192.168.1.100")
+	// The address is resolved when connecting, so a DHCP change is picked up by the next reconnect
+	c.inverterAutoDiscover = c.modbusMode == "tcp" && strings.EqualFold(c.inverterAddress, "auto")
+	serial, err := strconv.ParseUint(c.getEnv("SMA_INVERTER_SERIAL", "0"), 10, 32)
+	if err != nil {
+		c.logWarnf("Invalid SMA_INVERTER_SERIAL, discovery uses the first inverter found")
+		serial = 0
+	}
+	c.inverterSerial = uint32(serial)
+
+	c.solarOnlyCharge, err = strconv.ParseBool(c.getEnv("SOLAR_ONLY_CHARGE", "false"))
+	if err != nil {
+		c.solarOnlyCharge = false
+	}
+
+	// Minimum dwell times for the control on/off states
+	c.controlMinOnSeconds, err = strconv.Atoi(c.getEnv("CONTROL_MIN_ON_SECONDS", "0"))
+	if err != nil || c.controlMinOnSeconds < 0 {
+		c.controlMinOnSeconds = 0
+	}
+	c.controlMinOffSeconds, err = strconv.Atoi(c.getEnv("CONTROL_MIN_OFF_SECONDS", "0"))
+	if err != nil || c.controlMinOffSeconds < 0 {
+		c.controlMinOffSeconds = 0
+	}
+
+	c.publishRegisterMapEnabled, err = strconv.ParseBool(c.getEnv("PUBLISH_REGISTER_MAP", "false"))
+	if err != nil {
+		c.publishRegisterMapEnabled = false
+	}
+
+	c.balancedBackoffErrors, err = strconv.Atoi(c.getEnv("BALANCED_BACKOFF_ERRORS_PER_MINUTE", "0"))
+	if err != nil || c.balancedBackoffErrors < 0 {
+		c.balancedBackoffErrors = 0
+	}
+
+	c.debugRawControl, err = strconv.ParseBool(c.getEnv("DEBUG_RAW_CONTROL", "false"))
+	if err != nil {
+		c.debugRawControl = false
+	}
+	if c.debugRawControl {
+		c.logWarnf("DEBUG_RAW_CONTROL is enabled. raw_control_method/raw_power_command write directly to the inverter and bypass all control logic and safety checks.")
+	}
+
+	c.perSensorAvailability, err = strconv.ParseBool(c.getEnv("PER_SENSOR_AVAILABILITY", "false"))
+	if err != nil {
+		c.perSensorAvailability = false
+	}
+
+	// Mode to switch to while MQTT is disconnected ("" keeps the current mode)
+	c.mqttDisconnectMode = c.getEnv("MQTT_DISCONNECT_MODE", "")
+	if c.mqttDisconnectMode != "" {
+		valid := false
+		for _, mode := range logicOptions {
+			valid = valid || mode == c.mqttDisconnectMode
+		}
+		if !valid {
+			c.logWarnf("Invalid MQTT_DISCONNECT_MODE %q, disconnect fallback disabled", c.mqttDisconnectMode)
+			c.mqttDisconnectMode = ""
+		}
+	}
+	c.mqttDisconnectGraceSeconds, err = strconv.Atoi(c.getEnv("MQTT_DISCONNECT_GRACE_SECONDS", "60"))
+	if err != nil || c.mqttDisconnectGraceSeconds < 0 {
+		c.mqttDisconnectGraceSeconds = 60
+	}
+
+	c.decisionSnapshotEnabled, err = strconv.ParseBool(c.getEnv("DECISION_SNAPSHOT", "false"))
+	if err != nil {
+		c.decisionSnapshotEnabled = false
+	}
+
+	// Minimum interval between discovery republishes triggered by Home Assistant birth messages
+	c.discoveryRepublishMinSeconds, err = strconv.Atoi(c.getEnv("DISCOVERY_REPUBLISH_MIN_SECONDS", "30"))
+	if err != nil || c.discoveryRepublishMinSeconds < 0 {
+		c.discoveryRepublishMinSeconds = 30
+	}
+
+	c.reconnectSettlePolls, err = strconv.Atoi(c.getEnv("RECONNECT_SETTLE_POLLS", "2"))
+	if err != nil || c.reconnectSettlePolls < 0 {
+		c.reconnectSettlePolls = 2
+	}
+
+	// Initial Automatic release: "always" writes controlOff, "readback" only when 40151 shows external control
+	c.automaticInitialWrite = strings.ToLower(c.getEnv("AUTOMATIC_INITIAL_WRITE", "always"))
+	if c.automaticInitialWrite != "always" && c.automaticInitialWrite != "readback" {
+		c.logWarnf("Invalid AUTOMATIC_INITIAL_WRITE %q, using always", c.automaticInitialWrite)
+		c.automaticInitialWrite = "always"
+	}
+
+	c.debugRawWrites, err = strconv.ParseBool(c.getEnv("DEBUG_RAW_WRITES", "false"))
+	if err != nil {
+		c.debugRawWrites = false
+	}
+
+	c.combinedControlWrite, err = strconv.ParseBool(c.getEnv("COMBINED_CONTROL_WRITE", "false"))
+	if err != nil {
+		c.combinedControlWrite = false
+	}
+
+	// Clipping Charge detection
+	c.inverterAcLimitW, err = strconv.Atoi(c.getEnv("INVERTER_AC_LIMIT_W", "10000"))
+	if err != nil || c.inverterAcLimitW < 0 {
+		c.inverterAcLimitW = 10000
+	}
+	c.clippingMarginW, err = strconv.Atoi(c.getEnv("CLIPPING_MARGIN_W", "200"))
+	if err != nil || c.clippingMarginW < 0 {
+		c.clippingMarginW = 200
+	}
+
+	// PV curtailment for Zero Export with a full battery; the AC limit is written back afterwards
+	zeroExportLimitRegister, err := strconv.ParseUint(c.getEnv("ZERO_EXPORT_LIMIT_REGISTER", "0"), 10, 16)
+	if err != nil {
+		c.logWarnf("Invalid ZERO_EXPORT_LIMIT_REGISTER, PV curtailment disabled")
+		zeroExportLimitRegister = 0
+	}
+	if zeroExportLimitRegister != 0 && c.inverterAcLimitW == 0 {
+		c.logWarnf("ZERO_EXPORT_LIMIT_REGISTER needs INVERTER_AC_LIMIT_W to restore the limit, PV curtailment disabled")
+		zeroExportLimitRegister = 0
+	}
+	c.zeroExportLimitRegister = uint16(zeroExportLimitRegister)
+	c.pvLimitW = -1
+
+	// Time-of-use windows for Schedule, in SCHEDULE_TIMEZONE (container local time if empty)
+	c.scheduleLocation = time.Local
+	if tz := c.getEnv("SCHEDULE_TIMEZONE", ""); tz != "" {
+		if loc, err := time.LoadLocation(tz); err != nil {
+			c.logWarnf("Invalid SCHEDULE_TIMEZONE %q, using local time: %v", tz, err)
+		} else {
+			c.scheduleLocation = loc
+		}
+	}
+	c.lastScheduleWindow = -1
+	if schedule := c.getEnv("SCHEDULE", ""); schedule != "" {
+		c.scheduleWindows, err = parseSchedule(schedule)
+		if err != nil {
+			c.logWarnf("Invalid SCHEDULE, Schedule mode has no windows: %v", err)
+			c.scheduleWindows = nil
+		}
+		for _, w := range c.scheduleWindows {
+			c.logInfof("Schedule window %s-%s (%s): %s %dW", w.Start, w.End, c.scheduleLocation, w.Action, w.Power)
+		}
+	}
+
+	c.overwriteTimeoutMinutes, err = strconv.Atoi(c.getEnv("OVERWRITE_TIMEOUT_MINUTES", "0"))
+	if err != nil || c.overwriteTimeoutMinutes < 0 {
+		c.overwriteTimeoutMinutes = 0
+	}
+
+	// Pause (charge ok) hysteresis: release above the first feed-in threshold, hold again at the second
+	c.pauseReleaseExportW, err = strconv.Atoi(c.getEnv("PAUSE_RELEASE_EXPORT_W", "100"))
+	if err != nil || c.pauseReleaseExportW < 1 {
+		c.pauseReleaseExportW = 100
+	}
+	c.pauseHoldExportW, err = strconv.Atoi(c.getEnv("PAUSE_HOLD_EXPORT_W", "50"))
+	if err != nil || c.pauseHoldExportW < 0 || c.pauseHoldExportW >= c.pauseReleaseExportW {
+		c.logWarnf("Invalid PAUSE_HOLD_EXPORT_W, must be below PAUSE_RELEASE_EXPORT_W (%d); using %d", c.pauseReleaseExportW, c.pauseReleaseExportW/2)
+		c.pauseHoldExportW = c.pauseReleaseExportW / 2
+	}
+	c.pauseMinDwellSeconds, err = strconv.Atoi(c.getEnv("PAUSE_MIN_DWELL_SECONDS", "0"))
+	if err != nil || c.pauseMinDwellSeconds < 0 {
+		c.pauseMinDwellSeconds = 0
+	}
+
+	// Peak Shaving import cap
+	c.peakShaveLimitW, err = strconv.Atoi(c.getEnv("PEAK_SHAVE_LIMIT_W", "5000"))
+	if err != nil || c.peakShaveLimitW < 0 {
+		c.peakShaveLimitW = 5000
+	}
+
+	c.mqttMaxReconnectIntervalSeconds, err = strconv.Atoi(c.getEnv("MQTT_MAX_RECONNECT_INTERVAL_SECONDS", "60"))
+	if err != nil || c.mqttMaxReconnectIntervalSeconds < 1 {
+		c.mqttMaxReconnectIntervalSeconds = 60
+	}
+	mqttQos, err := strconv.Atoi(c.getEnv("MQTT_QOS", "0"))
+	if err != nil || mqttQos < 0 || mqttQos > 2 {
+		c.logWarnf("Invalid MQTT_QOS, using 0")
+		mqttQos = 0
+	}
+	c.mqttQos = byte(mqttQos)
+
+	c.discoveryPrefix = strings.Trim(c.getEnv("DISCOVERY_PREFIX", "homeassistant"), "/")
+	if c.discoveryPrefix == "" {
+		c.discoveryPrefix = "homeassistant"
+	}
+
+	c.healthMaxPollAgeSeconds, err = strconv.Atoi(c.getEnv("HEALTH_MAX_POLL_AGE_SECONDS", "60"))
+	if err != nil || c.healthMaxPollAgeSeconds < c.modbusIntervalInSeconds {
+		c.healthMaxPollAgeSeconds = 60
+	}
+
+	c.modbusRecoveryMaxAttempts, err = strconv.Atoi(c.getEnv("MODBUS_RECOVERY_MAX_ATTEMPTS", "10"))
+	if err != nil || c.modbusRecoveryMaxAttempts < 0 {
+		c.modbusRecoveryMaxAttempts = 10
+	}
+	c.modbusBackoffMaxSeconds, err = strconv.Atoi(c.getEnv("MODBUS_BACKOFF_MAX_SECONDS", "60"))
+	if err != nil || c.modbusBackoffMaxSeconds < 1 {
+		c.modbusBackoffMaxSeconds = 60
+	}
+
+	c.statusTopic = c.getEnv("STATUS_TOPIC", "")
+	if c.statusTopic == "" {
+		c.statusTopic = c.deviceID + "/status"
+	}
+
+	// Initialize control variables
+	c.automaticLogicSelection = "Automatic"
+	c.overwriteLogicSelection = "Off"
+	c.currentLogicSelection = "Automatic"
+	c.lastValidBatteryControl = 0
+	c.previousMode = ""
+	c.lastChangeTime = time.Now()
+	c.lastSuccessfulPoll = time.Now()
+	c.lastFullPoll = c.lastSuccessfulPoll
+
+	// Precompute topic prefixes and initialize caches
+	c.sensorTopicPrefix = c.discoveryPrefix + "/sensor/" + c.deviceID + "/"
+	c.selectStateTopicPrefix = c.discoveryPrefix + "/select/" + c.deviceID + "/"
+	c.numberStateTopicPrefix = c.discoveryPrefix + "/number/" + c.deviceID + "/"
+	c.lastSensorValues = make(map[string]string, 24)
+	c.sensorAvailable = make(map[string]bool, 24)
+	c.energyTotals = make(map[string]float64, len(powerSensors))
+	c.energyLastSamples = make(map[string]powerSample, len(powerSensors))
+}
+
+func (c *Controller) setupMQTT() {
+	// Set up MQTT options
+	opts := mqtt.NewClientOptions()
+	// Brokers are tried in order; paho falls over to the next one when a broker is unreachable
+	for _, brokerURL := range brokerURLs(c.getEnv("MQTT_SERVER_ADDRESS", "127.0.0.1"), c.getEnv("MQTT_SERVER_PORT", "1883")) {
+		opts.AddBroker(brokerURL)
+		c.logDebugf("MQTT broker: %s", brokerURL)
+	}
+	mqttUser := c.getEnv("MQTT_USER", "")
+	mqttPassword := c.getEnv("MQTT_PASSWORD", "")
+	if mqttUser != "" {
+		opts.Username = mqttUser
+		opts.Password = mqttPassword
+	}
+	opts.SetClientID(c.deviceID)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(time.Duration(c.mqttMaxReconnectIntervalSeconds) * time.Second)
+	opts.OnReconnecting = func(client mqtt.Client, o *mqtt.ClientOptions) {
+		c.logInfof("MQTT reconnecting")
+	}
+
+	// Set Last Will and Testament (LWT)
+	willPayload := "offline"
+	opts.SetWill(c.statusTopic, willPayload, c.mqttQos, true)
+
+	// Track broker connectivity for the disconnect fallback mode
+	opts.OnConnectionLost = func(client mqtt.Client, err error) {
+		c.onMqttConnectionLost(err)
+	}
+
+	// Publish birth message and restore subscriptions after (re)connection
+	opts.OnConnect = c.onMqttConnect
+
+	// Create and start MQTT client
+	c.mqttClient = mqtt.NewClient(opts)
+	if token := c.mqttClient.Connect(); token.Wait() && token.Error() != nil {
+		c.logFatalf("MQTT connection error: %v", token.Error())
+	}
+}
+
+// onMqttConnectionLost records the disconnect for the disconnect fallback mode and /healthz
+func (c *Controller) onMqttConnectionLost(err error) {
+	c.logWarnf("MQTT connection lost: %v", err)
+	c.statusMu.Lock()
+	c.mqttConnected = false
+	c.mqttDisconnectedAt = time.Now()
+	c.statusMu.Unlock()
+}
+
+// onMqttConnect restores the Overwrite selection and the subscriptions after a (re)connect and
+// publishes the birth message
+func (c *Controller) onMqttConnect(client mqtt.Client) {
+	c.statusMu.Lock()
+	if !c.mqttConnected && !c.mqttDisconnectedAt.IsZero() {
+		c.logInfof("MQTT reconnected")
+	}
+	c.mqttConnected = true
+	c.statusMu.Unlock()
+	c.restoreFromMqttFallback()
+	if c.mqttSubscriptionsReady {
+		c.subscribeCommandTopics(client)
+	}
+	birthTopic := c.statusTopic
+	birthPayload := "online"
+	token := client.Publish(birthTopic, c.mqttQos, true, birthPayload)
+	token.Wait()
+	c.logDebugf("Published birth message to %s", birthTopic)
+}
+
+// brokerURLs builds the broker list from comma-separated addresses and ports. An address may carry
+// its own port ("host:port"); otherwise the port at the same index is used, or the last port given.
+func brokerURLs(addresses, ports string) []string {
+	portList := strings.Split(ports, ",")
+	var urls []string
+	for i, address := range strings.Split(addresses, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			port := strings.TrimSpace(portList[len(portList)-1])
+			if i < len(portList) {
+				port = strings.TrimSpace(portList[i])
+			}
+			address = net.JoinHostPort(address, port)
+		}
+		urls = append(urls, "tcp://"+address)
+	}
+	return urls
+}
+
+func (c *Controller) publishDiscoveryMessages() {
+	// Device information
+	deviceInfo := map[string]interface{}{
+		"identifiers":  []string{c.deviceID},
+		"manufacturer": "Custom",
+		"model":        "SMA Battery Controller",
+		"name":         "SMA Battery Controller",
+		"sw_version":   version,
+	}
+
+	c.controlMu.Lock()
+	automatic, overwrite := c.automaticLogicSelection, c.overwriteLogicSelection
+	if c.batteryControl == 0 {
+		c.batteryControl = int(math.Round(float64(c.maximumBatteryControl) * 0.90)) // 90% of max control
+		c.lastValidBatteryControl = c.batteryControl
+	}
+	batteryControl, minimumSoc, maximumSoc := c.batteryControl, c.minimumSoc, c.maximumSoc
+	c.controlMu.Unlock()
+
+	// Always publish discovery for selects and number so HA can send commands
+	c.publishSelect("automatic_logic_selection", "Automatic Logic Selection", logicOptions, automatic, deviceInfo)
+	c.publishSelect("overwrite_logic_selection", "Overwrite Logic Selection", append([]string{"Off"}, logicOptions...), overwrite, deviceInfo)
+	// Optional mode buttons (set Overwrite Logic Selection when pressed); clear them when disabled
+	for _, mode := range logicOptions {
+		objectID := modeButtonObjectID(mode)
+		if c.modeButtonsEnabled {
+			c.publishButton(objectID, mode, deviceInfo)
+		} else {
+			configTopic := fmt.Sprintf("%s/button/%s/%s/config", c.discoveryPrefix, c.deviceID, objectID)
+			c.mqttPublish(configTopic, []byte(""), true)
+		}
+	}
+	c.publishButton("reset_error_count", "Reset Modbus Error Count", deviceInfo)
+	c.publishButton("force_reconnect", "Force Modbus Reconnect", deviceInfo)
+	c.publishSwitch("debug_logging", "Debug Logging", debugLogging(), deviceInfo)
+	// Make Current Logic Selection read-only by publishing as a sensor (no command topic)
+	c.publishSensor("current_logic_selection", "Current Logic Selection", "", "", "", deviceInfo)
+	// Remove old select-based Current Logic Selection entity by clearing its discovery and state
+	oldSelectConfigTopic := fmt.Sprintf("%s/select/%s/current_logic_selection/config", c.discoveryPrefix, c.deviceID)
+	c.mqttPublish(oldSelectConfigTopic, []byte(""), true)
+	oldSelectStateTopic := fmt.Sprintf("%s/select/%s/current_logic_selection/state", c.discoveryPrefix, c.deviceID)
+	c.mqttPublish(oldSelectStateTopic, []byte(""), true)
+
+	c.publishNumber("battery_control", "Battery Control", "W", "power", 0, float64(c.maximumBatteryControl), 100, float64(batteryControl), deviceInfo)
+	c.publishNumber("minimum_soc", "Minimum SOC", "%", "battery", 0, 100, 1, float64(minimumSoc), deviceInfo)
+	c.publishNumber("maximum_soc", "Maximum SOC", "%", "battery", 0, 100, 1, float64(maximumSoc), deviceInfo)
+	c.publishNumber("peak_shave_limit_w", "Peak Shave Limit", "W", "power", 0, 50000, 100, float64(c.peakShaveLimitW), deviceInfo)
+	// Raw control numbers for commissioning, only with DEBUG_RAW_CONTROL; cleared otherwise
+	if c.debugRawControl {
+		c.publishNumber("raw_control_method", "Raw Control Method (debug)", "", "", 0, 65535, 1, 0, deviceInfo)
+		c.publishNumber("raw_power_command", "Raw Power Command (debug)", "W", "power", -float64(c.maximumBatteryControl), float64(c.maximumBatteryControl), 1, 0, deviceInfo)
+	} else {
+		for _, objectID := range []string{"raw_control_method", "raw_power_command"} {
+			c.mqttPublish(fmt.Sprintf("%s/number/%s/%s/config", c.discoveryPrefix, c.deviceID, objectID), []byte(""), true)
+		}
+	}
+
+	// Publish sensors regardless of initial state
+	c.publishSensor("battery_status", "Battery Status", "", "", "", deviceInfo)
+	c.publishSensor("battery_soc", "Battery State of Charge", "%", "battery", "measurement", deviceInfo)
+	c.publishSensor("battery_temperature", "Battery Temperature", "°C", "temperature", "measurement", deviceInfo)
+	c.publishSensor("inverter_temperature", "Inverter Temperature", "°C", "temperature", "measurement", deviceInfo)
+	c.publishSensor("battery_diagnose_current_capacity", "Battery Health", "%", "", "measurement", deviceInfo)
+	c.publishSensor("battery_charge_power", "Battery Charge Power", "W", "power", "measurement", deviceInfo)
+	c.publishSensor("battery_discharge_power", "Battery Discharge Power", "W", "power", "measurement", deviceInfo)
+	c.publishSensor("dc1_current", "DC1 Current", "A", "current", "measurement", deviceInfo)
+	c.publishSensor("dc1_voltage", "DC1 Voltage", "V", "voltage", "measurement", deviceInfo)
+	c.publishSensor("dc1_power", "DC1 Power", "W", "power", "measurement", deviceInfo)
+	c.publishSensor("dc2_current", "DC1 Current", "A", "current", "measurement", deviceInfo)
+	c.publishSensor("dc2_voltage", "DC1 Voltage", "V", "voltage", "measurement", deviceInfo)
+	c.publishSensor("dc2_power", "DC1 Power", "W", "power", "measurement", deviceInfo)
+	c.publishSensor("ac_power", "AC Power", "W", "power", "measurement", deviceInfo)
+	if c.publishEnergyCounters {
+		c.publishSensor("total_yield", "Total Yield", "kWh", "energy", "total_increasing", deviceInfo)
+		c.publishSensor("daily_yield", "Daily Yield", "kWh", "energy", "total_increasing", deviceInfo)
+		c.publishSensor("battery_charge_energy_total", "Battery Charge Energy Total", "kWh", "energy", "total_increasing", deviceInfo)
+		c.publishSensor("battery_discharge_energy_total", "Battery Discharge Energy Total", "kWh", "energy", "total_increasing", deviceInfo)
+	}
+	if c.publishPhasePower {
+		c.publishSensor("ac_power_l1", "AC Power L1", "W", "power", "measurement", deviceInfo)
+		c.publishSensor("ac_power_l2", "AC Power L2", "W", "power", "measurement", deviceInfo)
+		c.publishSensor("ac_power_l3", "AC Power L3", "W", "power", "measurement", deviceInfo)
+	}
+	c.publishSensor("ac_voltage_l1", "AC Voltage L1", "V", "voltage", "measurement", deviceInfo)
+	c.publishSensor("grid_frequency", "Grid Frequency", "Hz", "frequency", "measurement", deviceInfo)
+	c.publishSensor("grid_feed", "Grid Feed Power", "W", "power", "measurement", deviceInfo)
+	c.publishSensor("grid_draw", "Grid Draw Power", "W", "power", "measurement", deviceInfo)
+	c.publishSensor("net_grid", "Net Grid Power", "W", "power", "measurement", deviceInfo)
+	c.publishSensor("grid_power", "Grid Power", "W", "power", "measurement", deviceInfo)
+	c.publishSensor("battery_power", "Battery Power", "W", "power", "measurement", deviceInfo)
+	if c.publishHouseLoad {
+		c.publishSensor("house_load", "House Load", "W", "power", "measurement", deviceInfo)
+	}
+	if c.publishSelfSufficiency {
+		c.publishSensor("self_sufficiency", "Self Sufficiency", "%", "", "measurement", deviceInfo)
+	}
+	if c.publishStartupRestore {
+		c.publishSensor("startup_restore", "Startup Restore", "", "", "", deviceInfo)
+	}
+	if c.publishInverterEfficiency {
+		c.publishSensor("inverter_efficiency", "Inverter Efficiency", "%", "", "measurement", deviceInfo)
+	}
+	c.publishSensor("modbus_error_count", "Modbus Error Count", "", "", "", deviceInfo)
+	c.publishSensor("controller_status", "Controller Status", "", "", "", deviceInfo)
+	c.publishSensor("build_info", "Build Info", "", "", "", deviceInfo)
+	if c.writeReadbackVerify {
+		c.publishSensor("last_command_confirmed", "Last Command Confirmed", "", "", "", deviceInfo)
+	}
+	if c.publishModbusUptime {
+		c.publishSensor("modbus_uptime", "Modbus Uptime", "s", "duration", "measurement", deviceInfo)
+	}
+	if c.decisionSnapshotEnabled {
+		c.publishSensor("control_decision", "Control Decision", "", "", "", deviceInfo)
+	}
+	if c.publishPollCounters {
+		c.publishSensor("polls_total", "Polls Total", "", "", "total_increasing", deviceInfo)
+		c.publishSensor("registers_read_total", "Registers Read Total", "", "", "total_increasing", deviceInfo)
+		c.publishSensor("publishes_total", "Sensor Publishes Total", "", "", "total_increasing", deviceInfo)
+		c.publishSensor("publishes_suppressed_total", "Sensor Publishes Suppressed Total", "", "", "total_increasing", deviceInfo)
+	}
+	// Additional registers from REGISTER_MAP_FILE
+	for _, r := range c.polledRegisters {
+		if !c.builtinRegisterNames[r.name] {
+			c.publishSensor(r.name, registerDisplayName(r.name), r.unit, r.deviceClass, r.stateClass, deviceInfo)
+		}
+	}
+	c.publishSensor("last_successful_poll", "Last Successful Poll", "", "timestamp", "", deviceInfo)
+
+	if c.energyOutput == "energy" {
+		for objectID, name := range powerSensors {
+			c.publishEnergySensor(energyObjectID(objectID), name, deviceInfo)
+		}
+	}
+	if c.batteryEnergyTotals {
+		c.publishEnergySensor("battery_charged_total", "Battery Charged Total", deviceInfo)
+		c.publishEnergySensor("battery_discharged_total", "Battery Discharged Total", deviceInfo)
+	}
+}
+
+// republishDiscovery republishes the discovery messages after a Home Assistant birth message,
+// at most once per discoveryRepublishMinSeconds so a flapping status topic cannot flood the broker.
+func (c *Controller) republishDiscovery() {
+	c.discoveryMu.Lock()
+	defer c.discoveryMu.Unlock()
+	if since := time.Since(c.lastDiscoveryPublish); since < time.Duration(c.discoveryRepublishMinSeconds)*time.Second {
+		c.logDebugf("Home Assistant online, discovery republish skipped (last %v ago)", since.Round(time.Second))
+		return
+	}
+	c.lastDiscoveryPublish = time.Now()
+	c.logInfof("Home Assistant online, republishing discovery")
+	c.publishDiscoveryMessages()
+}
+
+// registerDisplayName turns a register name like "grid_voltage_l2" into "Grid voltage l2"
+func registerDisplayName(name string) string {
+	display := strings.ReplaceAll(name, "_", " ")
+	return strings.ToUpper(display[:1]) + display[1:]
+}
+
+func (c *Controller) publishButton(objectID, name string, deviceInfo map[string]interface{}) {
+	configTopic := fmt.Sprintf("%s/button/%s/%s/config", c.discoveryPrefix, c.deviceID, objectID)
+	commandTopic := fmt.Sprintf("%s/button/%s/%s/set", c.discoveryPrefix, c.deviceID, objectID)
+
+	configPayload := map[string]interface{}{
+		"name":          name,
+		"command_topic": commandTopic,
+		"payload_press": "PRESS",
+		"unique_id":     fmt.Sprintf("%s_%s", c.deviceID, objectID),
+		"device":        deviceInfo,
+		"availability": []map[string]string{
+			{
+				"topic":       c.statusTopic,
+				"payload_on":  "online",
+				"payload_off": "offline",
+			},
+		},
+	}
+
+	payloadBytes, _ := json.Marshal(configPayload)
+	c.mqttPublish(configTopic, payloadBytes, true)
+}
+
+// modeButtonObjectID turns a mode name like "Pause (charge ok)" into "mode_pause_charge_ok"
+func modeButtonObjectID(mode string) string {
+	var b strings.Builder
+	b.WriteString("mode")
+	inWord := false
+	for _, c := range strings.ToLower(mode) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			if !inWord {
+				b.WriteByte('_')
+			}
+			b.WriteRune(c)
+			inWord = true
+		} else {
+			inWord = false
+		}
+	}
+	return b.String()
+}
+
+func (c *Controller) publishSelect(objectID, name string, options []string, initial string, deviceInfo map[string]interface{}) {
+	configTopic := fmt.Sprintf("%s/select/%s/%s/config", c.discoveryPrefix, c.deviceID, objectID)
+	commandTopic := fmt.Sprintf("%s/select/%s/%s/set", c.discoveryPrefix, c.deviceID, objectID)
+	stateTopic := fmt.Sprintf("%s/select/%s/%s/state", c.discoveryPrefix, c.deviceID, objectID)
+
+	configPayload := map[string]interface{}{
+		"name":          name,
+		"command_topic": commandTopic,
+		"state_topic":   stateTopic,
+		"options":       options,
+		"unique_id":     fmt.Sprintf("%s_%s", c.deviceID, objectID),
+		"device":        deviceInfo,
+		"availability": []map[string]string{
+			{
+				"topic":       c.statusTopic,
+				"payload_on":  "online",
+				"payload_off": "offline",
+			},
 		},
 	}
-
-	payloadBytes, _ := json.Marshal(configPayload)
-	mqttPublish(configTopic, payloadBytes, true)
+
+	payloadBytes, _ := json.Marshal(configPayload)
+	c.mqttPublish(configTopic, payloadBytes, true)
+
+	// Publish initial state, unless a retained state was found at startup
+	if !c.keepRetainedState(objectID) {
+		c.mqttPublish(stateTopic, []byte(initial), true)
+	}
+}
+
+// publishSwitch publishes a switch entity with ON/OFF payloads and its initial state
+func (c *Controller) publishSwitch(objectID, name string, initial bool, deviceInfo map[string]interface{}) {
+	configTopic := fmt.Sprintf("%s/switch/%s/%s/config", c.discoveryPrefix, c.deviceID, objectID)
+	commandTopic := fmt.Sprintf("%s/switch/%s/%s/set", c.discoveryPrefix, c.deviceID, objectID)
+	stateTopic := fmt.Sprintf("%s/switch/%s/%s/state", c.discoveryPrefix, c.deviceID, objectID)
+
+	configPayload := map[string]interface{}{
+		"name":            name,
+		"command_topic":   commandTopic,
+		"state_topic":     stateTopic,
+		"payload_on":      "ON",
+		"payload_off":     "OFF",
+		"entity_category": "config",
+		"unique_id":       fmt.Sprintf("%s_%s", c.deviceID, objectID),
+		"device":          deviceInfo,
+		"availability": []map[string]string{
+			{
+				"topic":       c.statusTopic,
+				"payload_on":  "online",
+				"payload_off": "offline",
+			},
+		},
+	}
+
+	payloadBytes, _ := json.Marshal(configPayload)
+	c.mqttPublish(configTopic, payloadBytes, true)
+
+	// Publish initial state
+	state := "OFF"
+	if initial {
+		state = "ON"
+	}
+	c.mqttPublish(stateTopic, []byte(state), true)
+}
+
+// publishNumber publishes a number entity; unit and deviceClass are omitted when empty
+func (c *Controller) publishNumber(objectID, name, unit, deviceClass string, min, max, step, initial float64, deviceInfo map[string]interface{}) {
+	configTopic := fmt.Sprintf("%s/number/%s/%s/config", c.discoveryPrefix, c.deviceID, objectID)
+	commandTopic := fmt.Sprintf("%s/number/%s/%s/set", c.discoveryPrefix, c.deviceID, objectID)
+	stateTopic := fmt.Sprintf("%s/number/%s/%s/state", c.discoveryPrefix, c.deviceID, objectID)
+
+	configPayload := map[string]interface{}{
+		"name":          name,
+		"command_topic": commandTopic,
+		"state_topic":   stateTopic,
+		"min":           min,
+		"max":           max,
+		"step":          step,
+		"unique_id":     fmt.Sprintf("%s_%s", c.deviceID, objectID),
+		"device":        deviceInfo,
+		"availability": []map[string]string{
+			{
+				"topic":       c.statusTopic,
+				"payload_on":  "online",
+				"payload_off": "offline",
+			},
+		},
+	}
+	if unit != "" {
+		configPayload["unit_of_measurement"] = unit
+	}
+	if deviceClass != "" {
+		configPayload["device_class"] = deviceClass
+	}
+
+	payloadBytes, _ := json.Marshal(configPayload)
+	c.mqttPublish(configTopic, payloadBytes, true)
+
+	// Publish initial state, unless a retained state was found at startup
+	if !c.keepRetainedState(objectID) {
+		c.mqttPublish(stateTopic, []byte(fmt.Sprintf("%.0f", initial)), true)
+	}
+}
+
+// keepRetainedState reports whether the first discovery publish leaves objectID's state topic alone
+// because its retained state was restored at startup. Later republishes send the current value.
+func (c *Controller) keepRetainedState(objectID string) bool {
+	return c.lastDiscoveryPublish.IsZero() && c.retainedStates[objectID]
+}
+
+func (c *Controller) publishSensor(objectID, name, unit, deviceClass, stateClass string, deviceInfo map[string]interface{}) {
+	configTopic := fmt.Sprintf("%s/sensor/%s/%s/config", c.discoveryPrefix, c.deviceID, objectID)
+	stateTopic := fmt.Sprintf("%s/sensor/%s/%s/state", c.discoveryPrefix, c.deviceID, objectID)
+
+	configPayload := map[string]interface{}{
+		"name":                name,
+		"state_topic":         stateTopic,
+		"unit_of_measurement": unit,
+		"value_template":      "{{ value }}",
+		"unique_id":           fmt.Sprintf("%s_%s", c.deviceID, objectID),
+		"device":              deviceInfo,
+		"availability": []map[string]string{
+			{
+				"topic":       c.statusTopic,
+				"payload_on":  "online",
+				"payload_off": "offline",
+			},
+		},
+	}
+
+	if deviceClass != "" {
+		configPayload["device_class"] = deviceClass
+	}
+	if stateClass != "" {
+		configPayload["state_class"] = stateClass
+	}
+	if diagnosticSensors[objectID] {
+		configPayload["entity_category"] = "diagnostic"
+	}
+	if attributeSensors[objectID] || (c.rawAttributes && c.isPolledRegister(objectID)) {
+		configPayload["json_attributes_topic"] = c.sensorTopicPrefix + objectID + "/attributes"
+	}
+	if c.perSensorAvailability && c.isPolledRegister(objectID) {
+		// Entity is available only while both the controller and this register's reads are
+		configPayload["availability"] = []map[string]string{
+			{
+				"topic":       c.statusTopic,
+				"payload_on":  "online",
+				"payload_off": "offline",
+			},
+			{
+				"topic":       c.sensorTopicPrefix + objectID + "/availability",
+				"payload_on":  "online",
+				"payload_off": "offline",
+			},
+		}
+		configPayload["availability_mode"] = "all"
+	}
+
+	payloadBytes, _ := json.Marshal(configPayload)
+	c.mqttPublish(configTopic, payloadBytes, true)
+}
+
+func (c *Controller) publishEnergySensor(objectID, name string, deviceInfo map[string]interface{}) {
+	configTopic := fmt.Sprintf("%s/sensor/%s/%s/config", c.discoveryPrefix, c.deviceID, objectID)
+	stateTopic := fmt.Sprintf("%s/sensor/%s/%s/state", c.discoveryPrefix, c.deviceID, objectID)
+
+	configPayload := map[string]interface{}{
+		"name":                name,
+		"state_topic":         stateTopic,
+		"unit_of_measurement": "kWh",
+		"device_class":        "energy",
+		"state_class":         "total_increasing",
+		"value_template":      "{{ value }}",
+		"unique_id":           fmt.Sprintf("%s_%s", c.deviceID, objectID),
+		"device":              deviceInfo,
+		"availability": []map[string]string{
+			{
+				"topic":       c.statusTopic,
+				"payload_on":  "online",
+				"payload_off": "offline",
+			},
+		},
+	}
+
+	payloadBytes, _ := json.Marshal(configPayload)
+	c.mqttPublish(configTopic, payloadBytes, true)
+}
+
+// SMA Speedwire discovery request, sent to the Speedwire multicast group
+var speedwireDiscoveryRequest = []byte{
+	0x53, 0x4d, 0x41, 0x00, 0x00, 0x04, 0x02, 0xa0,
+	0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x20,
+	0x00, 0x00, 0x00, 0x00,
+}
+
+// SMA Speedwire identification query (protocol 0x6065, command 0x00000200) addressed to any
+// SUSy-ID and serial. Every inverter answers with its own SUSy-ID and serial as the source address.
+var speedwireIdentifyRequest = []byte{
+	0x53, 0x4d, 0x41, 0x00, 0x00, 0x04, 0x02, 0xa0, // "SMA\0", tag 0x02a0
+	0x00, 0x00, 0x00, 0x01, 0x00, 0x26, 0x00, 0x10, // group 1, data length 38, tag 0x0010
+	0x60, 0x65, 0x09, 0xa0, // protocol 0x6065, 9 long words, control
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, // destination: any SUSy-ID, any serial
+	0x7d, 0x00, 0x52, 0xbe, 0x28, 0x3a, 0x00, 0x00, // source: this application
+	0x00, 0x00, 0x00, 0x00, 0x01, 0x80, // error code, fragment, packet ID
+	0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // command, range
+	0x00, 0x00, 0x00, 0x00, // end of packet
+}
+
+// parseSpeedwireIdentity returns the source SUSy-ID and serial of a Speedwire 0x6065 packet.
+// Other packets (e.g. energy meter telemetry, protocol 0x6069) are not inverter replies.
+func parseSpeedwireIdentity(packet []byte) (susyID uint16, serial uint32, ok bool) {
+	if len(packet) < 34 || string(packet[:4]) != "SMA\x00" ||
+		binary.BigEndian.Uint16(packet[14:16]) != 0x0010 || binary.BigEndian.Uint16(packet[16:18]) != 0x6065 {
+		return 0, 0, false
+	}
+	susyID = binary.LittleEndian.Uint16(packet[28:30])
+	serial = binary.LittleEndian.Uint32(packet[30:34])
+	// Our own query (SUSy-ID 125) is not an inverter
+	if susyID == 0x7d && serial == binary.LittleEndian.Uint32(speedwireIdentifyRequest[30:34]) {
+		return 0, 0, false
+	}
+	return susyID, serial, true
+}
+
+// discoverInverter sends the SMA Speedwire discovery and identification requests and returns the
+// IP of the first inverter that answers within timeout, or of the one with inverterSerial when set
+func (c *Controller) discoverInverter(timeout time.Duration) (string, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	group := &net.UDPAddr{IP: net.IPv4(239, 12, 255, 254), Port: 9522}
+	c.logInfof("Discovering SMA inverter via Speedwire multicast %s", group)
+	for _, request := range [][]byte{speedwireDiscoveryRequest, speedwireIdentifyRequest} {
+		if _, err := conn.WriteToUDP(request, group); err != nil {
+			return "", err
+		}
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 1024)
+	var found []string
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if c.inverterSerial != 0 {
+					return "", fmt.Errorf("no SMA inverter with serial %d answered within %s (found: %s)",
+						c.inverterSerial, timeout, strings.Join(found, ", "))
+				}
+				return "", fmt.Errorf("no SMA inverter answered within %s", timeout)
+			}
+			return "", err
+		}
+		susyID, serial, ok := parseSpeedwireIdentity(buf[:n])
+		if !ok {
+			continue
+		}
+		c.logInfof("Discovered SMA inverter at %s (SUSy-ID %d, serial %d)", addr.IP, susyID, serial)
+		if c.inverterSerial != 0 && serial != c.inverterSerial {
+			found = append(found, fmt.Sprintf("%d at %s", serial, addr.IP))
+			continue
+		}
+		return addr.IP.String(), nil
+	}
+}
+
+// setupModbus (re)connects the Modbus client, closing the previous connection first
+func (c *Controller) setupModbus() error {
+	c.logInfof("Setting up modbus (%s)", c.modbusMode)
+	var handler interface {
+		modbus.ClientHandler
+		modbusConnection
+	}
+	if c.modbusMode == "rtu" {
+		// Create Modbus RTU client handler on the serial RS485 adapter
+		rtu := modbus.NewRTUClientHandler(c.serialDevice)
+		rtu.BaudRate = c.serialBaudRate
+		rtu.DataBits = c.serialDataBits
+		rtu.Parity = c.serialParity
+		rtu.StopBits = c.serialStopBits
+		rtu.Timeout = 10 * time.Second
+		rtu.SlaveId = byte(c.modbusSlaveID)
+		handler = rtu
+	} else {
+		if c.inverterAutoDiscover {
+			address, err := c.discoverInverter(5 * time.Second)
+			if err != nil {
+				return fmt.Errorf("SMA inverter discovery failed: %w", err)
+			}
+			c.inverterAddress = address
+		}
+		// Create Modbus TCP client handler
+		tcp := modbus.NewTCPClientHandler(
+			fmt.Sprintf("%s:%s",
+				c.inverterAddress,
+				c.getEnv("SMA_INVERTER_MODBUS_PORT", "502")),
+		)
+		tcp.Timeout = 10 * time.Second
+		tcp.SlaveId = byte(c.modbusSlaveID)
+		handler = tcp
+	}
+
+	// Connect to Modbus device
+	c.modbusMu.Lock()
+	if c.modbusHandler != nil {
+		c.modbusHandler.Close()
+	}
+	err := handler.Connect()
+	if err != nil {
+		c.modbusMu.Unlock()
+		return err
+	}
+	c.modbusHandler = handler
+	c.modbusClient = modbus.NewClient(handler)
+	c.modbusReconnecting = false
+	if !c.modbusConnectedAt.IsZero() {
+		// Reconnect: read but do not publish values until the link has settled
+		c.settlePollsRemaining = c.reconnectSettlePolls
+	}
+	c.modbusConnectedAt = time.Now()
+	c.modbusMu.Unlock()
+	c.statusMu.Lock()
+	quiet := time.Since(c.modbusClientErrorTime) > 30*time.Minute
+	c.statusMu.Unlock()
+	if quiet {
+		c.modbusClientErrorCount.Store(0)
+	}
+	return nil
+}
+
+// countModbusError counts a failed Modbus request for the error count sensor, /healthz and the metrics
+func (c *Controller) countModbusError() {
+	c.modbusClientErrorCount.Add(1)
+	c.statusMu.Lock()
+	c.modbusClientErrorTime = time.Now()
+	c.statusMu.Unlock()
+}
+
+// reconnectModbus reconnects after a Modbus error with exponential backoff (1s, 2s, 4s, ... up to
+// modbusBackoffMaxSeconds, ±20% jitter). The controller is reported offline only once a connection
+// attempt fails, i.e. the inverter cannot be reached at all. The backoff starts over after each
+// successful reconnect. After modbusRecoveryMaxAttempts consecutive failed attempts control is
+// released and the process exits. Only the read loop calls it, so the backoff never blocks other goroutines.
+func (c *Controller) reconnectModbus(cause error) {
+	c.logWarnf("Trying to reconnect because of %v", cause)
+	c.modbusMu.Lock()
+	c.modbusReconnecting = true
+	c.modbusMu.Unlock()
+	c.publishControllerStatus()
+	offline := false
+	maxBackoff := time.Duration(c.modbusBackoffMaxSeconds) * time.Second
+	for attempt := 1; ; attempt++ {
+		if c.modbusBackoff <= 0 {
+			c.modbusBackoff = time.Second
+		}
+		delay := c.modbusBackoff + time.Duration(float64(c.modbusBackoff)*0.2*(rand.Float64()*2-1))
+		c.logDebugf("Modbus reconnect attempt %d in %s", attempt, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+		c.modbusBackoff *= 2
+		if c.modbusBackoff > maxBackoff {
+			c.modbusBackoff = maxBackoff
+		}
+		err := c.setupModbus()
+		if err == nil {
+			// Start the backoff over, so errors spread over a long time do not add up to the maximum delay
+			c.modbusBackoff = 0
+			c.logInfof("Modbus reconnected after %d attempt(s)", attempt)
+			if offline {
+				c.mqttPublish(c.statusTopic, []byte("online"), true)
+			}
+			c.publishControllerStatus()
+			return
+		}
+		c.logWarnf("Modbus reconnect attempt %d failed: %v", attempt, err)
+		if !offline {
+			// The connection itself is lost, not just a register read
+			c.mqttPublish(c.statusTopic, []byte("offline"), true)
+			offline = true
+		}
+		if c.modbusRecoveryMaxAttempts > 0 && attempt >= c.modbusRecoveryMaxAttempts {
+			c.logErrorf("Modbus recovery failed after %d attempts, releasing control and terminating", attempt)
+			shutdownAll()
+			os.Exit(1)
+		}
+	}
+}
+
+// Modes offered by the Automatic Logic Selection (Overwrite additionally offers "Off")
+var logicOptions = []string{"Automatic", "Balanced", "Pause (charge ok)", "Pause", "Charge Battery", "Discharge Battery", "Clipping Charge", "Peak Shaving", "Schedule", "Zero Export"}
+
+// Polled registers reported in W, with the name of the energy sensor derived from them
+var powerSensors = map[string]string{
+	"battery_charge_power":    "Battery Charge Energy",
+	"battery_discharge_power": "Battery Discharge Energy",
+	"dc1_power":               "DC1 Energy",
+	"dc2_power":               "DC2 Energy",
+	"ac_power":                "AC Energy",
+	"grid_feed":               "Grid Feed Energy",
+	"grid_draw":               "Grid Draw Energy",
+}
+
+// Battery energy totals (kWh since start, or persisted) integrated from the battery power registers
+var batteryTotalSensors = map[string]string{
+	"battery_charge_power":    "battery_charged_total",
+	"battery_discharge_power": "battery_discharged_total",
+}
+
+// Default SMA status codes for the battery_status register
+var defaultBatteryStatusTexts = map[int64]string{
+	35:       "Fault",
+	303:      "Off",
+	307:      "Ok",
+	455:      "Warning",
+	2291:     "Standby",
+	2292:     "Charging",
+	2293:     "Discharging",
+	16777213: "Not available",
+}
+
+// parseSensorBounds parses "name=min:max,..." into sanity bounds; either side may be empty
+func parseSensorBounds(value string) (map[string]valueBounds, error) {
+	bounds := make(map[string]valueBounds)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid entry %q", entry)
+		}
+		limits := strings.SplitN(parts[1], ":", 2)
+		if len(limits) != 2 {
+			return nil, fmt.Errorf("invalid range in %q", entry)
+		}
+		var b valueBounds
+		for i, limit := range limits {
+			limit = strings.TrimSpace(limit)
+			if limit == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(limit, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid limit in %q: %v", entry, err)
+			}
+			if i == 0 {
+				b.min = &v
+			} else {
+				b.max = &v
+			}
+		}
+		bounds[strings.TrimSpace(parts[0])] = b
+	}
+	return bounds, nil
+}
+
+// discardSentinel handles a "not available" reading: it is not published (with
+// SENSOR_BOUNDS_ACTION=unavailable the sensor is marked unavailable), power inputs of the control
+// logic drop to 0 (no measurement means no power flow, e.g. at night) and the SOC becomes unknown
+func (c *Controller) discardSentinel(name string, raw uint64) {
+	c.logDebugf("%s not available (0x%X)", name, raw)
+	if c.sensorBoundsAction == "unavailable" {
+		c.setSensorAvailability(name, false)
+	}
+	c.gridMu.Lock()
+	defer c.gridMu.Unlock()
+	switch name {
+	case "battery_discharge_power":
+		c.batteryDischargePower = 0
+	case "battery_charge_power":
+		c.batteryChargePower = 0
+	case "battery_soc":
+		c.batterySocKnown = false
+	case "ac_power":
+		c.acPower = 0
+	case "dc1_power":
+		c.dc1Power = 0
+	case "dc2_power":
+		c.dc2Power = 0
+	case "grid_feed":
+		c.gridFeed = 0
+	case "grid_draw":
+		c.gridDraw = 0
+	}
+}
+
+// parseSentinels parses a comma-separated list of 32-bit values (decimal or 0x hex)
+func parseSentinels(value string) ([]uint32, error) {
+	var sentinels []uint32
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(entry, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sentinel %q: %v", entry, err)
+		}
+		sentinels = append(sentinels, uint32(v))
+	}
+	return sentinels, nil
+}
+
+// withinBounds checks a scaled register value against its sanity bounds. Out-of-range values are
+// logged and, with SENSOR_BOUNDS_ACTION=unavailable, mark the sensor unavailable.
+func (c *Controller) withinBounds(name string, value float64) bool {
+	b, ok := c.sensorBounds[name]
+	if !ok || ((b.min == nil || value >= *b.min) && (b.max == nil || value <= *b.max)) {
+		return true
+	}
+	c.logWarnf("Discarding out-of-range %s value %g", name, value)
+	if c.sensorBoundsAction == "unavailable" {
+		c.setSensorAvailability(name, false)
+	}
+	return false
+}
+
+// parseEnumTexts parses "code=Text,code=Text" into a code to text map
+func parseEnumTexts(value string) (map[int64]string, error) {
+	texts := make(map[int64]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid entry %q", entry)
+		}
+		code, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid code in %q: %v", entry, err)
+		}
+		texts[code] = strings.TrimSpace(parts[1])
+	}
+	return texts, nil
+}
+
+// Sensors published with entity_category diagnostic
+var diagnosticSensors = map[string]bool{
+	"modbus_uptime":              true,
+	"control_decision":           true,
+	"polls_total":                true,
+	"registers_read_total":       true,
+	"publishes_total":            true,
+	"publishes_suppressed_total": true,
+	"inverter_efficiency":        true,
+	"startup_restore":            true,
+	"last_command_confirmed":     true,
+	"build_info":                 true,
+}
+
+// Sensors with a JSON attributes topic (<state topic prefix>/attributes)
+var attributeSensors = map[string]bool{
+	"control_decision": true,
+	"startup_restore":  true,
+	"build_info":       true,
+}
+
+// powerSample is the previous power reading used for energy integration
+type powerSample struct {
+	at    time.Time
+	watts float64
+}
+
+// Static list of polled input registers (2 words each)
+var defaultPolledRegisters = []regDef{
+	{name: "battery_status", addr: 31391},
+	{name: "battery_soc", addr: 30845, unit: "%"},
+	{name: "battery_temperature", addr: 30849, scale: 0.1, unit: "°C", signed: true},
+	{name: "battery_diagnose_current_capacity", addr: 30847, unit: "%"},
+	{name: "battery_charge_power", addr: 31393, unit: "W"},
+	{name: "battery_discharge_power", addr: 31395, unit: "W"},
+	{name: "dc1_current", addr: 30769, scale: 0.001, unit: "A", signed: true},
+	{name: "dc1_voltage", addr: 30771, scale: 0.01, unit: "V", signed: true},
+	{name: "dc1_power", addr: 30773, unit: "W", signed: true},
+	{name: "dc2_current", addr: 30957, scale: 0.001, unit: "A", signed: true},
+	{name: "dc2_voltage", addr: 30959, scale: 0.01, unit: "V", signed: true},
+	{name: "dc2_power", addr: 30961, unit: "W", signed: true},
+	{name: "ac_power", addr: 30775, unit: "W", signed: true},
+	{name: "ac_voltage_l1", addr: 30783, scale: 0.01, unit: "V"},
+	{name: "grid_frequency", addr: 30803, scale: 0.01, unit: "Hz"},
+	{name: "grid_feed", addr: 30867, unit: "W", signed: true},
+	{name: "grid_draw", addr: 30865, unit: "W", signed: true},
+	{name: "inverter_temperature", addr: 30953, scale: 0.01, unit: "°C", signed: true},
+}
+
+// loadRegisterMap reads and validates a register map file (YAML for .yaml/.yml, JSON otherwise)
+func loadRegisterMap(path string) ([]regDef, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []registerMapEntry
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		err = yaml.Unmarshal(data, &entries)
+	} else {
+		err = json.Unmarshal(data, &entries)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no registers defined")
+	}
+	regs := make([]regDef, 0, len(entries))
+	seen := make(map[string]bool, len(entries))
+	for i, e := range entries {
+		switch {
+		case e.Name == "":
+			return nil, fmt.Errorf("entry %d: missing name", i)
+		case seen[e.Name]:
+			return nil, fmt.Errorf("entry %d: duplicate name %q", i, e.Name)
+		case e.Address == 0:
+			return nil, fmt.Errorf("%s: missing address", e.Name)
+		case e.Words != 0 && e.Words != 2 && e.Words != 4:
+			return nil, fmt.Errorf("%s: words must be 2 or 4", e.Name)
+		case e.Scale < 0:
+			return nil, fmt.Errorf("%s: scale must not be negative", e.Name)
+		}
+		seen[e.Name] = true
+		regs = append(regs, regDef{name: e.Name, addr: e.Address, words: e.Words, scale: e.Scale, unit: e.Unit,
+			signed: e.Signed, deviceClass: e.DeviceClass, stateClass: e.StateClass})
+	}
+	return regs, nil
+}
+
+// Cumulative energy counters (Wh, published as kWh) for the Energy dashboard
+var energyCounterRegisters = []regDef{
+	{name: "total_yield", addr: 30529, scale: 0.001, unit: "kWh"},
+	{name: "daily_yield", addr: 30535, scale: 0.001, unit: "kWh"},
+	{name: "battery_charge_energy_total", addr: 31397, scale: 0.001, unit: "kWh", words: 4},
+	{name: "battery_discharge_energy_total", addr: 31401, scale: 0.001, unit: "kWh", words: 4},
+}
+
+// Optional per-phase AC power registers (PUBLISH_PHASE_POWER); single-phase inverters return sentinels
+var phasePowerRegisters = []regDef{
+	{name: "ac_power_l1", addr: 30777, unit: "W", signed: true},
+	{name: "ac_power_l2", addr: 30779, unit: "W", signed: true},
+	{name: "ac_power_l3", addr: 30781, unit: "W", signed: true},
+}
+
+func (c *Controller) modbusReadLoop() {
+	// Normal polling timer (re-armed with optional jitter) and a fast ticker used while in Balanced mode
+	normalTimer := time.NewTimer(c.nextPollInterval())
+	fastTicker := time.NewTicker(time.Duration(c.balancedIntervalSeconds) * time.Second)
+	resetTicker := time.NewTicker(time.Duration(c.resetIntervalMinutes) * time.Minute) // periodic control logic check
+	fullPublishTicker := time.NewTicker(30 * time.Minute)                              // force full sensor publish every 30 minutes
+	var watchdogC <-chan time.Time                                                     // liveness check, only when enabled
+	if c.readWatchdogSeconds > 0 {
+		watchdogC = time.NewTicker(1 * time.Second).C
+	}
+	var readback *readbackRequest // post-write read-back armed on readbackC
+	var readbackC <-chan time.Time
+	if c.automaticInitialWrite == "readback" {
+		c.readInitialControlMethod()
+	}
+	for {
+		select {
+		case <-watchdogC:
+			c.checkReadWatchdog()
+		case <-fastTicker.C:
+			// When Balanced overwrite is active, poll every balancedIntervalSeconds for quick reactions
+			if c.overwriteSelection() == "Balanced" && !c.ecoActive && !c.checkBalancedBackoff() {
+				c.readAndPublishData()
+				c.checkPauseChargeOkMode()
+			}
+		case <-normalTimer.C:
+			c.checkMqttDisconnect()
+			c.checkOverwriteTimeout()
+			c.checkEcoWindow()
+			if c.ecoActive {
+				// Eco: slow monitoring only, no control
+				if time.Since(c.lastEcoPoll) >= time.Duration(c.ecoIntervalSeconds)*time.Second {
+					c.lastEcoPoll = time.Now()
+					c.readAndPublishData()
+				}
+			} else if c.overwriteSelection() != "Balanced" || c.balancedBackoff {
+				// In non-Balanced modes (or Balanced backed off after errors), poll at the configured interval
+				c.readAndPublishData()
+				c.checkPauseChargeOkMode()
+			}
+			normalTimer.Reset(c.nextPollInterval())
+		case <-resetTicker.C:
+			c.applyControlLogic()
+		case <-c.readbackSignal:
+			// A newer write replaces a read-back that has not run yet; its acks go out with the newer one
+			c.controlMu.Lock()
+			if c.readbackPending != nil {
+				if readbackC != nil {
+					c.readbackPending.acks = append(readback.acks, c.readbackPending.acks...)
+				}
+				readback, c.readbackPending = c.readbackPending, nil
+				readbackC = time.After(readback.delay)
+			}
+			c.controlMu.Unlock()
+		case <-readbackC:
+			readbackC = nil
+			c.postWriteReadback(readback)
+		case <-c.pollSignal:
+			c.readAndPublishData()
+		case <-fullPublishTicker.C:
+			// Clear cache to force publish of all sensors, then read and publish immediately
+			c.forceFullPublish()
+			c.readAndPublishData()
+		}
+	}
+}
+
+// checkBalancedBackoff falls back from the fast Balanced poll to the normal interval while the
+// read error count of the last minute is at or above balancedBackoffErrors, and resumes once no
+// errors occurred for a minute. Returns true while backed off.
+func (c *Controller) checkBalancedBackoff() bool {
+	if c.balancedBackoffErrors <= 0 {
+		return false
+	}
+	cutoff := time.Now().Add(-time.Minute)
+	c.readErrorsMu.Lock()
+	i := 0
+	for i < len(c.recentReadErrors) && c.recentReadErrors[i].Before(cutoff) {
+		i++
+	}
+	c.recentReadErrors = c.recentReadErrors[i:]
+	recent := len(c.recentReadErrors)
+	c.readErrorsMu.Unlock()
+	if !c.balancedBackoff && recent >= c.balancedBackoffErrors {
+		c.balancedBackoff = true
+		c.logWarnf("Balanced: %d read errors in the last minute, falling back to the %ds poll interval", recent, c.modbusIntervalInSeconds)
+	} else if c.balancedBackoff && recent == 0 {
+		c.balancedBackoff = false
+		c.logInfof("Balanced: read errors subsided, resuming fast polling")
+	}
+	return c.balancedBackoff
+}
+
+// checkOverwriteTimeout resets an active Overwrite selection to Off when no command has been received
+// for overwriteTimeoutMinutes, so a forced mode does not run on indefinitely when Home Assistant is gone
+func (c *Controller) checkOverwriteTimeout() {
+	if c.overwriteTimeoutMinutes <= 0 {
+		return
+	}
+	c.controlMu.Lock()
+	if c.overwriteLogicSelection == "Off" || c.mqttFallbackActive ||
+		time.Since(c.lastChangeTime) < time.Duration(c.overwriteTimeoutMinutes)*time.Minute {
+		c.controlMu.Unlock()
+		return
+	}
+	c.logWarnf("No command for %d minutes, resetting Overwrite %s to Off", c.overwriteTimeoutMinutes, c.overwriteLogicSelection)
+	c.overwriteLogicSelection = "Off"
+	c.lastChangeTime = time.Now()
+	c.controlMu.Unlock()
+	stateTopic := fmt.Sprintf("%s/select/%s/overwrite_logic_selection/state", c.discoveryPrefix, c.deviceID)
+	c.mqttPublish(stateTopic, []byte("Off"), true)
+	c.applyControlLogic()
+}
+
+// checkMqttDisconnect switches to mqttDisconnectMode once MQTT has been disconnected for longer
+// than the grace period; the user's Overwrite selection is restored when the broker returns
+func (c *Controller) checkMqttDisconnect() {
+	if c.mqttDisconnectMode == "" {
+		return
+	}
+	c.statusMu.Lock()
+	connected, disconnectedAt := c.mqttConnected, c.mqttDisconnectedAt
+	c.statusMu.Unlock()
+	if connected || time.Since(disconnectedAt) < time.Duration(c.mqttDisconnectGraceSeconds)*time.Second {
+		return
+	}
+	c.controlMu.Lock()
+	if c.mqttFallbackActive {
+		c.controlMu.Unlock()
+		return
+	}
+	c.mqttFallbackActive = true
+	c.mqttFallbackSaved = c.overwriteLogicSelection
+	c.overwriteLogicSelection = c.mqttDisconnectMode
+	c.controlMu.Unlock()
+	c.logWarnf("MQTT disconnected for more than %ds, switching to %s", c.mqttDisconnectGraceSeconds, c.mqttDisconnectMode)
+	c.applyControlLogic()
+}
+
+// restoreFromMqttFallback restores the Overwrite selection saved by checkMqttDisconnect, if the
+// fallback is active
+func (c *Controller) restoreFromMqttFallback() {
+	c.controlMu.Lock()
+	if !c.mqttFallbackActive {
+		c.controlMu.Unlock()
+		return
+	}
+	c.mqttFallbackActive = false
+	c.overwriteLogicSelection = c.mqttFallbackSaved
+	c.controlMu.Unlock()
+	c.logInfof("MQTT reconnected, restoring Overwrite Logic Selection %s", c.mqttFallbackSaved)
+	go c.applyControlLogic()
+}
+
+// checkEcoWindow enters or leaves the eco low-activity state based on the configured time window.
+// On entry control can optionally be released once; on exit the current mode is re-applied.
+func (c *Controller) checkEcoWindow() {
+	if c.ecoStartMinute < 0 {
+		return
+	}
+	now := time.Now()
+	minute := now.Hour()*60 + now.Minute()
+	var inWindow bool
+	if c.ecoStartMinute <= c.ecoEndMinute {
+		inWindow = minute >= c.ecoStartMinute && minute < c.ecoEndMinute
+	} else {
+		// Window crosses midnight
+		inWindow = minute >= c.ecoStartMinute || minute < c.ecoEndMinute
+	}
+	if inWindow == c.ecoActive {
+		return
+	}
+	c.controlMu.Lock()
+	c.ecoActive = inWindow
+	if c.ecoActive {
+		c.logInfof("Entering eco mode: polling every %ds, no control writes", c.ecoIntervalSeconds)
+		if c.ecoReleaseControl {
+			c.writeControlCommands(c.controlOff, 0)
+		}
+	} else {
+		c.logInfof("Leaving eco mode, resuming normal control")
+	}
+	// Force the mode to be re-applied once eco ends
+	c.previousMode = ""
+	c.controlMu.Unlock()
+	c.publishControllerStatus()
+	if !c.ecoActive {
+		c.applyControlLogic()
+	}
+}
+
+// parseClock parses "HH:MM" into minutes since midnight
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// scheduleWindow is one entry of SCHEDULE, e.g. {"start":"22:00","end":"06:00","action":"charge","power":3000}
+type scheduleWindow struct {
+	Start       string `json:"start"`
+	End         string `json:"end"`
+	Action      string `json:"action"`          // charge, discharge or pause
+	Power       int    `json:"power,omitempty"` // W, 0 uses battery_control
+	startMinute int
+	endMinute   int
+}
+
+// parseSchedule parses the SCHEDULE JSON list of windows
+func parseSchedule(value string) ([]scheduleWindow, error) {
+	var windows []scheduleWindow
+	if err := json.Unmarshal([]byte(value), &windows); err != nil {
+		return nil, err
+	}
+	for i := range windows {
+		w := &windows[i]
+		start, errStart := parseClock(w.Start)
+		end, errEnd := parseClock(w.End)
+		if errStart != nil || errEnd != nil || start == end {
+			return nil, fmt.Errorf("window %d: invalid times %q-%q", i+1, w.Start, w.End)
+		}
+		w.Action = strings.ToLower(w.Action)
+		if w.Action != "charge" && w.Action != "discharge" && w.Action != "pause" {
+			return nil, fmt.Errorf("window %d: invalid action %q", i+1, w.Action)
+		}
+		if w.Power < 0 {
+			return nil, fmt.Errorf("window %d: negative power %d", i+1, w.Power)
+		}
+		w.startMinute = start
+		w.endMinute = end
+	}
+	return windows, nil
+}
+
+// activeScheduleWindow returns the index of the first window containing the current time in
+// scheduleLocation, or -1 if none does
+func (c *Controller) activeScheduleWindow() int {
+	now := time.Now().In(c.scheduleLocation)
+	minute := now.Hour()*60 + now.Minute()
+	for i, w := range c.scheduleWindows {
+		if w.startMinute <= w.endMinute {
+			if minute >= w.startMinute && minute < w.endMinute {
+				return i
+			}
+		} else if minute >= w.startMinute || minute < w.endMinute {
+			// Window crosses midnight
+			return i
+		}
+	}
+	return -1
+}
+
+// untilNextScheduleBoundary returns the time from now to the next start or end of a schedule window
+// in scheduleLocation
+func (c *Controller) untilNextScheduleBoundary(now time.Time) time.Duration {
+	now = now.In(c.scheduleLocation)
+	var next time.Time
+	for _, w := range c.scheduleWindows {
+		for _, minute := range []int{w.startMinute, w.endMinute} {
+			t := time.Date(now.Year(), now.Month(), now.Day(), minute/60, minute%60, 0, 0, c.scheduleLocation)
+			if !t.After(now) {
+				t = time.Date(now.Year(), now.Month(), now.Day()+1, minute/60, minute%60, 0, 0, c.scheduleLocation)
+			}
+			if next.IsZero() || t.Before(next) {
+				next = t
+			}
+		}
+	}
+	return next.Sub(now)
+}
+
+// scheduleLoop is the scheduler of Schedule mode. It evaluates the windows on every reset interval
+// and at each window start and end, and applies the control logic when Schedule is the active mode
+// and a different window (or none) is due.
+func (c *Controller) scheduleLoop() {
+	resetTicker := time.NewTicker(time.Duration(c.resetIntervalMinutes) * time.Minute)
+	boundaryTimer := time.NewTimer(c.untilNextScheduleBoundary(time.Now()))
+	for {
+		select {
+		case <-resetTicker.C:
+		case <-boundaryTimer.C:
+			boundaryTimer.Reset(c.untilNextScheduleBoundary(time.Now()))
+		}
+		c.controlMu.Lock()
+		due := c.resolveMode() == "Schedule" && c.activeScheduleWindow() != c.lastScheduleWindow
+		c.controlMu.Unlock()
+		if due {
+			c.applyControlLogic()
+		}
+	}
+}
+
+// publishRegisterMap logs and publishes (retained) the polled register table as resolved at startup
+func (c *Controller) publishRegisterMap() {
+	type registerInfo struct {
+		Name         string   `json:"name"`
+		Address      uint16   `json:"address"`
+		Words        int      `json:"words"`
+		Scale        float64  `json:"scale"`
+		Unit         string   `json:"unit"`
+		FunctionCode int      `json:"function_code"`
+		Source       string   `json:"source"`
+		Min          *float64 `json:"min,omitempty"`
+		Max          *float64 `json:"max,omitempty"`
+		PollGroup    string   `json:"poll_group"`
+		Signed       bool     `json:"signed"`
+	}
+	registers := make([]registerInfo, 0, len(c.polledRegisters))
+	for _, r := range c.polledRegisters {
+		b := c.sensorBounds[r.name]
+		source := "built-in"
+		if c.registerMapFile != "" {
+			source = c.registerMapFile
+		}
+		info := registerInfo{r.name, r.addr, int(r.wordCount()), r.scaleFactor(), r.unit, 4, source, b.min, b.max, c.registerPollGroups[r.name], r.signed}
+		c.logInfof("Register %s: address=%d words=%d scale=%g unit=%q function=%d source=%s group=%s signed=%t", info.Name, info.Address, info.Words, info.Scale, info.Unit, info.FunctionCode, info.Source, info.PollGroup, info.Signed)
+		registers = append(registers, info)
+	}
+	payloadBytes, _ := json.Marshal(registers)
+	c.mqttPublish(c.deviceID+"/register_map", payloadBytes, true)
+}
+
+// readBlock is a run of registers read with a single ReadInputRegisters request
+type readBlock struct {
+	addr  uint16
+	words uint16
+	regs  []regDef
+}
+
+// readResult is the raw register data (or error) of one register
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// planReadBlocks groups registers by address into blocks, merging registers whose gap to the
+// previous one is at most batchGapWords, up to the 125-word Modbus limit
+func (c *Controller) planReadBlocks(regs []regDef) []readBlock {
+	sorted := append([]regDef(nil), regs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].addr < sorted[j].addr })
+	var blocks []readBlock
+	for _, r := range sorted {
+		if n := len(blocks); n > 0 {
+			b := &blocks[n-1]
+			end := b.addr + b.words
+			if r.addr >= end && int(r.addr-end) <= c.batchGapWords && int(r.addr+r.wordCount()-b.addr) <= 125 {
+				b.words = r.addr + r.wordCount() - b.addr
+				b.regs = append(b.regs, r)
+				continue
+			}
+		}
+		blocks = append(blocks, readBlock{addr: r.addr, words: r.wordCount(), regs: []regDef{r}})
+	}
+	return blocks
+}
+
+// readRegisters reads the given registers, batching contiguous ones when MODBUS_BATCH_READS is on.
+// A failed block read falls back to individual reads of its registers.
+func (c *Controller) readRegisters(regs []regDef) map[uint16]readResult {
+	results := make(map[uint16]readResult, len(regs))
+	readSingle := func(r regDef) {
+		c.modbusMu.Lock()
+		data, err := c.modbusClient.ReadInputRegisters(r.addr, r.wordCount())
+		c.modbusMu.Unlock()
+		if err == nil && len(data) < int(r.wordCount())*2 {
+			err = fmt.Errorf("short response (%d bytes)", len(data))
+		}
+		results[r.addr] = readResult{data, err}
+	}
+	if !c.batchReads {
+		for _, r := range regs {
+			readSingle(r)
+		}
+		return results
+	}
+	for _, b := range c.planReadBlocks(regs) {
+		if len(b.regs) == 1 {
+			readSingle(b.regs[0])
+			continue
+		}
+		c.modbusMu.Lock()
+		data, err := c.modbusClient.ReadInputRegisters(b.addr, b.words)
+		c.modbusMu.Unlock()
+		if err != nil || len(data) < int(b.words)*2 {
+			c.logDebugf("Block read %d+%d failed, reading registers individually: %v", b.addr, b.words, err)
+			for _, r := range b.regs {
+				readSingle(r)
+			}
+			continue
+		}
+		for _, r := range b.regs {
+			offset := int(r.addr-b.addr) * 2
+			results[r.addr] = readResult{data: data[offset : offset+int(r.wordCount())*2]}
+		}
+	}
+	return results
+}
+
+// registerPollDue reports whether a register's polling group interval has elapsed since its last
+// read and records the read time. Registers in a group with interval 0 are read every poll.
+// Like every poll it runs on the read loop only, which is what keeps lastRegisterPoll unlocked.
+func (c *Controller) registerPollDue(name string) bool {
+	interval := c.pollGroupIntervals[c.registerPollGroups[name]]
+	if interval > 0 {
+		if last, ok := c.lastRegisterPoll[name]; ok && time.Since(last) < time.Duration(interval)*time.Second {
+			return false
+		}
+	}
+	c.lastRegisterPoll[name] = time.Now()
+	return true
+}
+
+// nextPollInterval returns the normal poll interval with ±pollJitterPercent random jitter
+func (c *Controller) nextPollInterval() time.Duration {
+	interval := time.Duration(c.modbusIntervalInSeconds) * time.Second
+	if c.pollJitterPercent == 0 {
+		return interval
+	}
+	jitter := float64(interval) * float64(c.pollJitterPercent) / 100 * (rand.Float64()*2 - 1)
+	return interval + time.Duration(jitter)
+}
+
+// checkReadWatchdog forces a Modbus reconnect when no poll has fully succeeded within
+// readWatchdogSeconds, and exits after readWatchdogMaxRestarts fruitless reconnects. A register the
+// inverter rejects with an exception does not fail a poll; a read that gets no answer does.
+func (c *Controller) checkReadWatchdog() {
+	if time.Since(c.lastFullPoll) < time.Duration(c.readWatchdogSeconds)*time.Second {
+		return
+	}
+	if c.readWatchdogMaxRestarts > 0 && c.readWatchdogRestarts >= c.readWatchdogMaxRestarts {
+		c.logErrorf("Read watchdog: no successful poll since %s after %d reconnects, releasing control and terminating", c.lastFullPoll.Format(time.RFC3339), c.readWatchdogRestarts)
+		shutdownAll()
+		os.Exit(1)
+	}
+	c.readWatchdogRestarts++
+	c.logWarnf("Read watchdog: no successful poll since %s, forcing Modbus reconnect (%d)", c.lastFullPoll.Format(time.RFC3339), c.readWatchdogRestarts)
+	// Restart the timeout so the reconnect gets a full period to recover
+	c.lastFullPoll = time.Now()
+	if err := c.setupModbus(); err != nil {
+		c.logWarnf("Read watchdog: reconnect failed: %v", err)
+	}
+}
+
+// readAndPublishData polls the due registers and publishes the sensors and derived values. It runs on
+// the read loop only, which is also the only place that reconnects Modbus.
+func (c *Controller) readAndPublishData() {
+	c.modbusMu.Lock()
+	reconnecting, cause := c.modbusReconnecting, c.modbusLastError
+	c.modbusMu.Unlock()
+	if reconnecting {
+		// A failed write or a forced reconnect left the connection to be re-established before polling
+		c.reconnectModbus(cause)
+	}
+	readErrors := 0
+	// Right after a reconnect, values are read (to verify the link) but not published
+	settling := c.settlePollsRemaining > 0
+	if c.modbusReconnectEachPoll {
+		// Open a fresh connection for this batch; errors surface through the reads below
+		c.modbusMu.Lock()
+		if err := c.modbusHandler.Connect(); err != nil {
+			c.logDebugf("Modbus connect for poll failed: %v", err)
+		}
+		c.modbusMu.Unlock()
+		defer func() {
+			c.modbusMu.Lock()
+			c.modbusHandler.Close()
+			c.modbusMu.Unlock()
+		}()
+	}
+	due := make([]regDef, 0, len(c.polledRegisters))
+	for _, r := range c.polledRegisters {
+		if c.registerPollDue(r.name) {
+			due = append(due, r)
+		}
+	}
+	readStart := time.Now()
+	results := c.readRegisters(due)
+	metricReadDuration.WithLabelValues(c.deviceID).Observe(time.Since(readStart).Seconds())
+	for _, r := range due {
+		name := r.name
+		if c.gridSenseInvert {
+			// Reversed grid CT: grid_feed and grid_draw are swapped
+			switch name {
+			case "grid_feed":
+				name = "grid_draw"
+			case "grid_draw":
+				name = "grid_feed"
+			}
+		}
+		result, err := results[r.addr].data, results[r.addr].err
+		var exception *modbus.ModbusError
+		if errors.As(err, &exception) {
+			// The inverter answered, but rejected this register (e.g. illegal address on this model):
+			// only this sensor is unavailable, the connection is fine
+			c.logWarnf("Inverter rejected %s register: %v", name, err)
+			metricReadErrors.WithLabelValues(c.deviceID).Inc()
+			c.setSensorAvailability(name, false)
+			continue
+		}
+		if err != nil {
+			c.logWarnf("Error reading %s register: %v", name, err)
+			metricReadErrors.WithLabelValues(c.deviceID).Inc()
+			c.countModbusError()
+			c.modbusMu.Lock()
+			c.modbusLastError = err
+			c.modbusMu.Unlock()
+			readErrors++
+			c.setSensorAvailability(name, false)
+			if c.balancedBackoffErrors > 0 {
+				c.readErrorsMu.Lock()
+				c.recentReadErrors = append(c.recentReadErrors, time.Now())
+				c.readErrorsMu.Unlock()
+			}
+			continue
+		}
+		c.registersReadTotal++
+		raw := r.rawValue(result)
+		if c.rawAttributes && !settling {
+			c.publishRawRegister(name, r, raw)
+		}
+		if r.isSentinel(raw, c.signedSentinels, c.unsignedSentinels) {
+			c.discardSentinel(name, raw)
+			continue
+		}
+		value := r.decode(raw)
+		if factor, ok := c.powerCorrections[name]; ok {
+			// Proportional correction (e.g. CT reading low); also feeds the control logic
+			value = int64(math.Round(float64(value) * factor))
+		}
+
+		// Apply scaling and update control variables
+		valueFloat := float64(value) * r.scaleFactor()
+		if !c.withinBounds(name, valueFloat) {
+			continue
+		}
+		c.setSensorAvailability(name, true)
+		c.gridMu.Lock()
+		switch name {
+		case "battery_discharge_power":
+			c.batteryDischargePower = int(value)
+		case "battery_charge_power":
+			c.batteryChargePower = int(value)
+		case "battery_soc":
+			c.batterySoc = int(value)
+			c.batterySocKnown = true
+		case "ac_power":
+			c.acPower = int(value)
+		case "dc1_power":
+			c.dc1Power = int(value)
+		case "dc2_power":
+			c.dc2Power = int(value)
+		case "grid_feed":
+			c.gridFeed = int(value)
+		case "grid_draw":
+			c.gridDraw = int(value)
+		}
+		c.gridMu.Unlock()
+
+		// Build payload string efficiently and publish only if changed
+		var payloadStr string
+		if int64(valueFloat) != value {
+			// format float with trimming to avoid noisy changes
+			payloadStr = strconv.FormatFloat(valueFloat, 'f', 2, 64)
+		} else {
+			payloadStr = strconv.FormatInt(value, 10)
+		}
+		// Decode enum registers (e.g. battery_status 2292 → "Charging"); unknown codes stay numeric
+		if codes, ok := c.enumTexts[name]; ok {
+			if text, ok := codes[value]; ok {
+				payloadStr = text
+			}
+		}
+		if settling {
+			continue
+		}
+		c.publishSensorState(name, payloadStr)
+
+		if c.energyOutput == "energy" && powerSensors[name] != "" {
+			c.integrateEnergy(name, valueFloat)
+		}
+		if c.batteryEnergyTotals && batteryTotalSensors[name] != "" {
+			c.integrateBatteryTotal(batteryTotalSensors[name], valueFloat)
+		}
+	}
+
+	// Net grid power (positive = import, negative = export), used by the control logic instead of the raw pair
+	c.gridMu.Lock()
+	c.netGrid = c.gridDraw - c.gridFeed
+	net, load := c.netGrid, c.houseLoad()
+	// Signed battery power: positive = discharging, negative = charging
+	battery := c.batteryDischargePower - c.batteryChargePower
+	efficiency, efficiencyOk := c.inverterEfficiency()
+	sufficiency, sufficiencyOk := c.selfSufficiency(load)
+	c.gridMu.Unlock()
+	if !settling {
+		c.publishSensorState("net_grid", strconv.Itoa(net))
+		// Same signed value under the grid_power name
+		c.publishSensorState("grid_power", strconv.Itoa(net))
+		c.publishSensorState("battery_power", strconv.Itoa(battery))
+		if c.publishHouseLoad {
+			c.publishSensorState("house_load", strconv.Itoa(load))
+		}
+		if c.publishInverterEfficiency && efficiencyOk {
+			c.publishSensorState("inverter_efficiency", strconv.FormatFloat(efficiency, 'f', 1, 64))
+		}
+		if c.publishSelfSufficiency && sufficiencyOk {
+			c.publishSensorState("self_sufficiency", strconv.FormatFloat(sufficiency, 'f', 1, 64))
+		}
+	}
+
+	// Publish modbus error count
+	c.publishSensorState("modbus_error_count", strconv.FormatInt(c.modbusClientErrorCount.Load(), 10))
+
+	if settling && readErrors == 0 {
+		c.settlePollsRemaining--
+		c.logDebugf("Post-reconnect settle poll, values not published (%d remaining)", c.settlePollsRemaining)
+	}
+
+	if readErrors > 0 {
+		c.modbusMu.Lock()
+		cause := c.modbusLastError
+		c.modbusMu.Unlock()
+		c.reconnectModbus(cause)
+	}
+
+	if readErrors == 0 {
+		c.controlMu.Lock()
+		c.controlInputsReady = true
+		c.controlMu.Unlock()
+		now := time.Now()
+		c.lastFullPoll = now
+		c.readWatchdogRestarts = 0
+		c.statusMu.Lock()
+		c.lastSuccessfulPoll = now
+		c.statusMu.Unlock()
+		c.publishSensorState("last_successful_poll", now.Format(time.RFC3339))
+		if c.heartbeatTopic != "" {
+			// Liveness counter for external watchers; a stalled value means the controller is stuck
+			c.heartbeatCount++
+			c.mqttPublish(c.heartbeatTopic, []byte(strconv.FormatInt(c.heartbeatCount, 10)), false)
+		}
+	}
+
+	c.pollsTotal++
+	if c.publishPollCounters {
+		c.publishSensorState("polls_total", strconv.FormatInt(c.pollsTotal, 10))
+		c.publishSensorState("registers_read_total", strconv.FormatInt(c.registersReadTotal, 10))
+		c.publishSensorState("publishes_total", strconv.FormatInt(c.publishesTotal.Load(), 10))
+		c.publishSensorState("publishes_suppressed_total", strconv.FormatInt(c.publishesSuppressedTotal.Load(), 10))
+	}
+
+	if c.publishModbusUptime {
+		uptime := int64(time.Since(c.modbusConnectedAt).Seconds())
+		c.publishSensorState("modbus_uptime", strconv.FormatInt(uptime, 10))
+	}
+
+	if c.powerFlowTopic != "" && !settling {
+		c.publishPowerFlow()
+	}
+
+	c.publishControllerStatus()
+}
+
+// houseLoad derives the home consumption from the polled values:
+// load = PV (dc1 + dc2) + battery discharge - battery charge + grid draw - grid feed.
+// All inputs are non-negative registers; transient negatives (unsynchronized reads) are clamped to 0.
+func (c *Controller) houseLoad() int {
+	load := c.dc1Power + c.dc2Power + c.batteryDischargePower - c.batteryChargePower + c.netGrid
+	if load < 0 {
+		return 0
+	}
+	return load
+}
+
+// inverterEfficiency returns AC output as a percentage of DC input, where DC input is
+// PV (dc1 + dc2) plus battery discharge minus battery charge (the battery sits on the DC side).
+// Below efficiencyMinPowerW the ratio is not meaningful and ok is false; the result is clamped to 0-100.
+func (c *Controller) inverterEfficiency() (float64, bool) {
+	dcInput := c.dc1Power + c.dc2Power + c.batteryDischargePower - c.batteryChargePower
+	if dcInput < c.efficiencyMinPowerW || dcInput <= 0 {
+		return 0, false
+	}
+	efficiency := float64(c.acPower) / float64(dcInput) * 100
+	return math.Max(0, math.Min(100, efficiency)), true
+}
+
+// selfSufficiency returns the share of the house load not imported from the grid (positive net grid),
+// in percent (0-100). ok is false while the load is zero, so the last published value is kept.
+func (c *Controller) selfSufficiency(load int) (float64, bool) {
+	if load <= 0 {
+		return 0, false
+	}
+	share := float64(load-max(c.netGrid, 0)) / float64(load) * 100
+	return math.Max(0, math.Min(100, share)), true
+}
+
+// publishControllerStatus publishes a one-line summary of the controller's condition when it changes
+func (c *Controller) publishControllerStatus() {
+	c.modbusMu.Lock()
+	reconnecting := c.modbusReconnecting
+	c.modbusMu.Unlock()
+	c.controlMu.Lock()
+	writeFailed, mode := c.lastWriteFailed, c.currentLogicSelection
+	c.controlMu.Unlock()
+	errorCount := c.modbusClientErrorCount.Load()
+	var status string
+	switch {
+	case reconnecting:
+		status = fmt.Sprintf("Reconnecting to inverter (%d errors)", errorCount)
+	case writeFailed:
+		status = fmt.Sprintf("Write failed, read-only (%d errors)", errorCount)
+	case c.ecoActive:
+		status = fmt.Sprintf("Eco, monitoring only, %d errors", errorCount)
+	default:
+		status = fmt.Sprintf("Running, %s, %d errors", mode, errorCount)
+	}
+	c.publishSensorState("controller_status", status)
+}
+
+// publishPowerFlow publishes PV, battery, grid and load in one JSON object (all in W).
+// Sign conventions: battery > 0 discharging, < 0 charging; grid > 0 importing, < 0 exporting;
+// load is houseLoad, the same value as the house_load sensor.
+func (c *Controller) publishPowerFlow() {
+	c.gridMu.RLock()
+	pv := c.dc1Power + c.dc2Power
+	battery := c.batteryDischargePower - c.batteryChargePower
+	grid := c.netGrid
+	load := c.houseLoad()
+	c.gridMu.RUnlock()
+	payload := fmt.Sprintf(`{"pv":%d,"battery":%d,"grid":%d,"load":%d}`, pv, battery, grid, load)
+	if !c.sensorValueChanged("power_flow", payload) {
+		return
+	}
+	c.mqttPublishTelemetry(c.powerFlowTopic, []byte(payload))
+}
+
+// energyObjectID maps a power sensor to its energy sensor, e.g. dc1_power -> dc1_energy, grid_feed -> grid_feed_energy
+func energyObjectID(powerObjectID string) string {
+	return strings.TrimSuffix(powerObjectID, "_power") + "_energy"
+}
+
+// integrateEnergy adds the energy since the previous sample (trapezoidal rule) and publishes the total in kWh.
+// Gaps longer than 15 minutes (e.g. during a Modbus outage) are not integrated.
+func (c *Controller) integrateEnergy(objectID string, watts float64) {
+	if watts < 0 {
+		return
+	}
+	now := time.Now()
+	c.energyMu.Lock()
+	if prev, ok := c.energyLastSamples[objectID]; ok {
+		hours := now.Sub(prev.at).Hours()
+		if hours > 0 && hours <= 0.25 {
+			c.energyTotals[objectID] += (prev.watts + watts) / 2 * hours / 1000
+		}
+	}
+	c.energyLastSamples[objectID] = powerSample{at: now, watts: watts}
+	total := c.energyTotals[objectID]
+	c.energyMu.Unlock()
+	c.publishSensorState(energyObjectID(objectID), strconv.FormatFloat(total, 'f', 3, 64))
+}
+
+// integrateBatteryTotal adds battery power to a since-boot (or persisted) kWh total using the
+// trapezoidal rule, and saves the totals to energyStateFile at most once a minute
+func (c *Controller) integrateBatteryTotal(objectID string, watts float64) {
+	if watts < 0 {
+		return
+	}
+	now := time.Now()
+	c.energyMu.Lock()
+	if prev, ok := c.batteryTotalSamples[objectID]; ok {
+		hours := now.Sub(prev.at).Hours()
+		if hours > 0 && hours <= 0.25 {
+			c.batteryTotals[objectID] += (prev.watts + watts) / 2 * hours / 1000
+		}
+	}
+	c.batteryTotalSamples[objectID] = powerSample{at: now, watts: watts}
+	total := c.batteryTotals[objectID]
+	save := c.energyStateFile != "" && now.Sub(c.lastEnergyStateSave) >= time.Minute
+	if save {
+		c.lastEnergyStateSave = now
+	}
+	c.energyMu.Unlock()
+	c.publishSensorState(objectID, strconv.FormatFloat(total, 'f', 3, 64))
+	if save {
+		c.saveBatteryTotals()
+	}
+}
+
+// loadBatteryTotals restores the battery energy totals from energyStateFile, if present
+func (c *Controller) loadBatteryTotals() {
+	data, err := os.ReadFile(c.energyStateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.logErrorf("Error reading energy state file: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &c.batteryTotals); err != nil {
+		c.logErrorf("Error parsing energy state file, starting from zero: %v", err)
+		c.batteryTotals = make(map[string]float64, len(batteryTotalSensors))
+		return
+	}
+	c.logInfof("Restored battery energy totals: %v", c.batteryTotals)
+}
+
+// saveBatteryTotals writes the battery energy totals to energyStateFile via a temporary file
+func (c *Controller) saveBatteryTotals() {
+	c.energyMu.Lock()
+	data, _ := json.Marshal(c.batteryTotals)
+	c.energyMu.Unlock()
+	tmp := c.energyStateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		c.logErrorf("Error writing energy state file: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, c.energyStateFile); err != nil {
+		c.logErrorf("Error writing energy state file: %v", err)
+	}
+}
+
+// isPolledRegister reports whether objectID is one of the polled registers
+func (c *Controller) isPolledRegister(objectID string) bool {
+	for _, r := range c.polledRegisters {
+		if r.name == objectID {
+			return true
+		}
+	}
+	return false
+}
+
+// setSensorAvailability publishes a register's own availability when it changes (perSensorAvailability only)
+func (c *Controller) setSensorAvailability(objectID string, available bool) {
+	if !c.perSensorAvailability {
+		return
+	}
+	c.sensorCacheMu.Lock()
+	last, ok := c.sensorAvailable[objectID]
+	c.sensorAvailable[objectID] = available
+	c.sensorCacheMu.Unlock()
+	if ok && last == available {
+		return
+	}
+	payload := "offline"
+	if available {
+		payload = "online"
+	}
+	c.mqttPublish(c.sensorTopicPrefix+objectID+"/availability", []byte(payload), true)
+}
+
+// sensorValueChanged records payload as the last value for objectID and reports whether it differs
+// from the cached one
+func (c *Controller) sensorValueChanged(objectID, payload string) bool {
+	c.sensorCacheMu.Lock()
+	defer c.sensorCacheMu.Unlock()
+	if last, ok := c.lastSensorValues[objectID]; ok && last == payload {
+		return false
+	}
+	c.lastSensorValues[objectID] = payload
+	return true
+}
+
+// forceFullPublish clears the sensor value cache so the next poll publishes every sensor
+func (c *Controller) forceFullPublish() {
+	c.sensorCacheMu.Lock()
+	c.lastSensorValues = make(map[string]string, len(c.polledRegisters)+1)
+	c.sensorCacheMu.Unlock()
+}
+
+// publishSensorState publishes a sensor state only if it changed since the last publish
+func (c *Controller) publishSensorState(objectID, payload string) {
+	if !c.sensorValueChanged(objectID, payload) {
+		c.publishesSuppressedTotal.Add(1)
+		return
+	}
+	c.publishesTotal.Add(1)
+	c.mqttPublishTelemetry(c.sensorTopicPrefix+objectID+"/state", []byte(payload))
+}
+
+// resolveMode returns the effective mode: the Overwrite selection unless it is "Off"
+// Callers hold controlMu.
+func (c *Controller) resolveMode() string {
+	if c.overwriteLogicSelection != "Off" {
+		return c.overwriteLogicSelection
+	}
+	return c.automaticLogicSelection
+}
+
+func (c *Controller) checkPauseChargeOkMode() {
+	if c.controlEvaluationDue() {
+		c.applyControlLogic()
+	}
+}
+
+// controlEvaluationDue reports whether the mode has to be evaluated again after a poll. It holds
+// controlMu, since the selections and the last command are also changed from the MQTT handler.
+func (c *Controller) controlEvaluationDue() bool {
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	// Run an evaluation that was deferred until the control inputs were populated
+	if c.controlDeferred && c.controlInputsReady {
+		c.controlDeferred = false
+		return true
+	}
+	currentMode := c.resolveMode()
+	// Continuously react in Balanced only when Overwrite is actively set to Balanced (not in Automatic mode)
+	if c.overwriteLogicSelection == "Balanced" {
+		return true
+	}
+	c.gridMu.RLock()
+	discharging := c.batteryDischargePower > 0
+	atReserve := c.batterySocKnown && c.batterySoc <= c.minimumSoc
+	atCeiling := c.batterySocKnown && c.batterySoc >= c.maximumSoc
+	c.gridMu.RUnlock()
+	switch {
+	case currentMode == "Pause (charge ok)" && !c.pauseActivated && discharging:
+		return true
+	// Follow the PV surplus every poll when charging is limited to solar or clipped power
+	case (c.solarOnlyCharge && currentMode == "Charge Battery") || currentMode == "Clipping Charge":
+		return true
+	// Track the grid import every poll to hold it at the peak shaving limit, and the feed-in for Zero Export
+	case currentMode == "Peak Shaving" || currentMode == "Zero Export":
+		return true
+	// Stop a running forced discharge as soon as the SOC reaches the reserve
+	case currentMode == "Discharge Battery" && atReserve && c.lastSpntCom == c.controlOn && c.lastPwrAtCom > 0:
+		return true
+	// Stop a running forced charge as soon as the SOC reaches the ceiling
+	case currentMode == "Charge Battery" && atCeiling && c.lastSpntCom == c.controlOn && c.lastPwrAtCom < 0:
+		return true
+	}
+	// Keep stepping the power command while a soft-start ramp is in progress
+	return c.softStartCycles > 0 && c.lastSpntCom == c.controlOn && c.softStartStep < c.softStartCycles
+}
+
+// readbackRequest is a post-write read-back handed to the read loop
+type readbackRequest struct {
+	spntCom  uint32        // Written SpntCom (0 = nothing written)
+	pwrAtCom int32         // Written PwrAtCom
+	delay    time.Duration // Time the inverter gets to apply the command before the read-back
+	acks     []commandAck  // MQTT commands acknowledged once the read-back has run
+}
+
+// commandAck identifies an MQTT command whose acknowledgement waits for the write read-back
+type commandAck struct {
+	requestID int64
+	command   string
+	value     string
+	mode      string
+	written   bool
+}
+
+// applyControlLogic evaluates the current mode and writes the resulting command. The read-back and
+// sensor refresh are handed to the read loop, so callers are not held up by postCommandDelayMs and
+// Modbus reads only ever run on the read loop.
+func (c *Controller) applyControlLogic() {
+	c.applyControlLogicAck(nil)
+}
+
+// applyCommand applies a command received over MQTT like applyControlLogic. Its acknowledgement is
+// published once the read-back of the resulting write has run, or right away when nothing was written.
+func (c *Controller) applyCommand(objectID, value string) {
+	c.controlMu.Lock()
+	c.commandSeq++
+	ack := &commandAck{requestID: c.commandSeq, command: objectID, value: value}
+	c.controlMu.Unlock()
+	c.applyControlLogicAck(ack)
+}
+
+// applyControlLogicAck evaluates and writes the control command; ack (may be nil) is attached to the read-back
+func (c *Controller) applyControlLogicAck(ack *commandAck) {
+	readback, mode, spntCom, pwrAtCom := c.evaluateControl()
+	if ack != nil {
+		ack.mode = mode
+		ack.written = spntCom != 0
+	}
+	if !readback {
+		if ack != nil {
+			c.publishCommandAck(*ack, false, false)
+		}
+		return
+	}
+	req := &readbackRequest{spntCom: spntCom, pwrAtCom: pwrAtCom}
+	if ack != nil {
+		req.acks = []commandAck{*ack}
+	}
+	if spntCom != 0 && mode != "Balanced" {
+		// Give inverter a brief moment to apply new settings before reading back. In Balanced mode
+		// we must react quickly based on grid values: skip the post_command delay
+		req.delay = time.Duration(c.postCommandDelayMs) * time.Millisecond
+	}
+	c.requestReadback(req)
+}
+
+// requestPoll asks the read loop to read and publish the sensors outside the normal interval, so
+// Modbus reads and reconnects stay on the read loop
+func (c *Controller) requestPoll() {
+	select {
+	case c.pollSignal <- struct{}{}:
+	default:
+		// A poll is already requested
+	}
+}
+
+// requestReadback queues req for the read loop, replacing a read-back that has not been picked up yet
+func (c *Controller) requestReadback(req *readbackRequest) {
+	c.controlMu.Lock()
+	if c.readbackPending != nil {
+		req.acks = append(c.readbackPending.acks, req.acks...)
+	}
+	c.readbackPending = req
+	c.controlMu.Unlock()
+	select {
+	case c.readbackSignal <- struct{}{}:
+	default:
+		// The read loop has not consumed the previous signal yet; it will pick up req with it
+	}
+}
+
+// postWriteReadback verifies the written command when enabled (spntCom 0 = nothing written) and
+// reads and publishes the sensors. It runs on the read loop. controlMu is only held to check and
+// record the command, not during the reads, retries and delays of the check.
+func (c *Controller) postWriteReadback(req *readbackRequest) {
+	spntCom, pwrAtCom := req.spntCom, req.pwrAtCom
+	verified, confirmed := false, false
+	c.controlMu.Lock()
+	// Skip the check when the write failed or a newer command has been written meanwhile
+	check := spntCom != 0 && c.writeReadbackVerify && !c.lastWriteFailed && c.lastSpntCom == spntCom && c.lastPwrAtCom == pwrAtCom
+	c.controlMu.Unlock()
+	if check {
+		confirmed, verified = c.verifyControlWrite(spntCom, pwrAtCom)
+	}
+	c.controlMu.Lock()
+	if verified && c.lastSpntCom == spntCom && c.lastPwrAtCom == pwrAtCom {
+		c.lastCommandConfirmed = confirmed
+	} else {
+		verified = false
+	}
+	failed := c.lastWriteFailed
+	c.controlMu.Unlock()
+	if verified {
+		state := "off"
+		if confirmed {
+			state = "on"
+		}
+		c.publishSensorState("last_command_confirmed", state)
+	}
+	// No ack when the write the commands caused failed
+	if !failed {
+		for _, ack := range req.acks {
+			c.publishCommandAck(ack, verified, confirmed)
+		}
+	}
+	// Always read and publish after evaluating/applying control changes
+	c.readAndPublishData()
+}
+
+// evaluateControl resolves the mode and writes the command it yields, holding controlMu. readback is
+// false when nothing was evaluated (eco, raw control, deferred, Automatic unchanged); spntCom is 0
+// when no command was written.
+func (c *Controller) evaluateControl() (readback bool, currentMode string, spntCom uint32, pwrAtCom int32) {
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	if c.ecoActive {
+		// Eco mode: monitoring only, the mode is applied again when eco ends
+		return
+	}
+	if c.rawControlActive {
+		// Raw debug control owns the registers until raw_control_method is set back to 0
+		return
+	}
+	if c.waitForFirstPoll && !c.controlInputsReady {
+		// Grid/SOC values are still zero-initialized; evaluate after the first successful poll
+		if !c.controlDeferred {
+			c.logInfof("Control deferred until the first successful poll")
+		}
+		c.controlDeferred = true
+		return
+	}
+	if c.automaticInitialWrite == "readback" && !c.initialControlMethodRead {
+		// The read loop reads 40151 before its first poll; evaluate once it has
+		if !c.controlDeferred {
+			c.logInfof("Control deferred until the control method has been read")
+		}
+		c.controlDeferred = true
+		return
+	}
+	currentMode = c.resolveMode()
+
+	if currentMode != c.currentLogicSelection {
+		c.currentLogicSelection = currentMode
+		metricMode.DeletePartialMatch(prometheus.Labels{"device_id": c.deviceID})
+		metricMode.WithLabelValues(c.deviceID, currentMode).Set(1)
+		// Publish current logic selection as a read-only sensor state
+		stateTopic := fmt.Sprintf("%s/sensor/%s/current_logic_selection/state", c.discoveryPrefix, c.deviceID)
+		c.mqttPublish(stateTopic, []byte(c.currentLogicSelection), true)
+	}
+
+	// Track Balanced activation so battery_control can be returned to a predictable value on exit
+	if currentMode == "Balanced" && c.overwriteLogicSelection == "Balanced" {
+		if !c.balancedActive {
+			c.balancedActive = true
+			c.balancedEntryBatteryControl = c.batteryControl
+		}
+	} else if c.balancedActive {
+		c.balancedActive = false
+		c.returnFromBalanced()
+	}
+
+	// The mode decides on a copy of the polled inputs, so a concurrent poll cannot change them midway
+	// and the poll is not held up while the decision publishes
+	c.gridMu.RLock()
+	c.inputs = controlInputs{
+		gridDraw:              c.gridDraw,
+		gridFeed:              c.gridFeed,
+		netGrid:               c.netGrid,
+		batteryChargePower:    c.batteryChargePower,
+		batteryDischargePower: c.batteryDischargePower,
+		acPower:               c.acPower,
+		dc1Power:              c.dc1Power,
+		dc2Power:              c.dc2Power,
+		batterySoc:            c.batterySoc,
+		batterySocKnown:       c.batterySocKnown,
+		peakShaveLimitW:       c.peakShaveLimitW,
+	}
+	c.gridMu.RUnlock()
+
+	// Only apply control logic if mode has changed or not in "Automatic" mode
+	apply := currentMode != c.previousMode || (currentMode != "Automatic" && !(currentMode == "Pause (charge ok)" && !c.pauseActivated && c.inputs.netGrid < -c.pauseHoldExportW && c.inputs.batteryDischargePower == 0))
+	if !apply {
+		// In "Automatic" mode and mode has not changed, do not send commands
+		return
+	}
+	c.logInfof("Applying control logic: Mode=%s", currentMode)
+	c.decisionBranch = ""
+	c.applyMode(currentMode, &spntCom, &pwrAtCom)
+
+	c.previousMode = currentMode
+
+	// Optionally skip the first Automatic release when the inverter is not under external control
+	if currentMode == "Automatic" && !c.initialAutomaticChecked {
+		c.initialAutomaticChecked = true
+		if c.automaticInitialWrite == "readback" && spntCom == c.controlOff {
+			if c.initialControlMethodErr != nil {
+				c.logErrorf("Error reading control method, sending release: %v", c.initialControlMethodErr)
+			} else if c.initialControlMethod != c.controlOn {
+				c.logInfof("Control method is %d (not external control), skipping initial Automatic release", c.initialControlMethod)
+				spntCom = 0
+				c.decisionBranch += "_initial_skipped"
+			}
+		}
+	}
+
+	rampStep := 0
+	if spntCom == c.controlOn {
+		pwrAtCom, rampStep = c.softStart(pwrAtCom)
+	}
+
+	if spntCom != 0 && !c.controlDwellAllows(spntCom) {
+		// Retry on the next evaluation, even if the mode does not change
+		spntCom = 0
+		c.previousMode = ""
+		c.decisionBranch += "_dwell_suppressed"
+	}
+
+	if c.decisionSnapshotEnabled {
+		c.publishDecisionSnapshot(currentMode, spntCom, pwrAtCom)
+	}
+
+	if spntCom != 0 {
+		// Write control commands to Modbus; a ramp step only counts once it has been written
+		if c.writeControlCommands(spntCom, pwrAtCom) && rampStep > 0 {
+			c.softStartStep = rampStep
+		}
+	}
+	return true, currentMode, spntCom, pwrAtCom
+}
+
+// softStart ramps the power command from 0 to target over softStartCycles poll cycles
+// after external control is enabled (control off → on); afterwards target is returned unchanged.
+// It returns the ramped command and its step (0 outside a ramp); the caller records the step
+// once the command has been written.
+func (c *Controller) softStart(target int32) (int32, int) {
+	if c.softStartCycles <= 0 {
+		return target, 0
+	}
+	if c.lastSpntCom != c.controlOn {
+		c.softStartStep = 0
+	}
+	if c.softStartStep >= c.softStartCycles {
+		return target, 0
+	}
+	step := c.softStartStep + 1
+	c.decisionBranch += "_soft_start"
+	ramped := target * int32(step) / int32(c.softStartCycles)
+	c.logInfof("Soft-start step %d/%d: power command %dW of %dW", step, c.softStartCycles, ramped, target)
+	return ramped, step
+}
+
+// solarChargeLimit caps a charge setpoint to the current PV surplus when solarOnlyCharge is set,
+// so Charge Battery never pulls from the grid. The surplus counts power already going into the
+// battery: surplus = -net_grid + battery_charge - battery_discharge.
+func (c *Controller) solarChargeLimit(target int) int {
+	if !c.solarOnlyCharge {
+		return target
+	}
+	surplus := -c.inputs.netGrid + c.inputs.batteryChargePower - c.inputs.batteryDischargePower
+	if surplus < 0 {
+		surplus = 0
+	}
+	if target > surplus {
+		c.logInfof("Charge limited by available solar: %dW of %dW", surplus, target)
+		c.decisionBranch += "_solar_limited"
+		return surplus
+	}
+	return target
+}
+
+// controlDwellAllows enforces the minimum on/off dwell times: once external control has been
+// enabled (or released) it is not switched back before controlMinOnSeconds (controlMinOffSeconds)
+func (c *Controller) controlDwellAllows(spntCom uint32) bool {
+	if c.lastSpntCom == 0 || spntCom == c.lastSpntCom {
+		return true
+	}
+	minDwell := c.controlMinOffSeconds
+	if c.lastSpntCom == c.controlOn {
+		minDwell = c.controlMinOnSeconds
+	}
+	elapsed := time.Since(c.lastControlChange)
+	if elapsed < time.Duration(minDwell)*time.Second {
+		c.logInfof("Suppressing control toggle %d → %d: only %s since last change (minimum %ds)", c.lastSpntCom, spntCom, elapsed.Round(time.Second), minDwell)
+		return false
+	}
+	return true
+}
+
+// zeroControl sets the command for battery_control == 0 in Charge, Discharge and Balanced according
+// to zeroControlPolicy: "release" hands the battery back to the inverter (controlOff), "hold" keeps
+// external control at 0W, "legacy" keeps the mode's historical command (legacySpntCom, 0 = no write).
+func (c *Controller) zeroControl(spntCom *uint32, pwrAtCom *int32, legacySpntCom uint32) {
+	*pwrAtCom = 0
+	c.decisionBranch += "_zero_" + c.zeroControlPolicy
+	switch c.zeroControlPolicy {
+	case "release":
+		*spntCom = c.controlOff
+		if c.lastSpntCom == c.controlOff {
+			// Already released; avoid repeating the write every cycle
+			*spntCom = 0
+		}
+	case "hold":
+		*spntCom = c.controlOn
+	default:
+		*spntCom = legacySpntCom
+	}
+	c.logDebugf("battery_control is 0, zero control policy %s → SpntCom=%d", c.zeroControlPolicy, *spntCom)
+}
+
+func (c *Controller) applyMode(mode string, spntCom *uint32, pwrAtCom *int32) {
+	if mode != "Zero Export" {
+		c.restorePvLimit()
+	}
+	switch mode {
+	case "Pause (charge ok)":
+		*spntCom = c.controlOn
+		if c.pauseChargeOkRelease() {
+			c.pauseActivated = false
+			c.decisionBranch = "pause_charge_ok_release"
+			// Allow charging up to the specified battery control value
+			*spntCom = c.controlOff
+			*pwrAtCom = 0
+			c.logDebugf("We are supplying Power, disable control")
+		} else {
+			c.pauseActivated = true
+			c.decisionBranch = "pause_charge_ok_hold"
+			// if we supply energy to the grid, turn on charging
+			*pwrAtCom = 0
+			c.logDebugf("Battery is discharging, setting power command to 0W")
+		}
+	case "Pause":
+		c.pauseActivated = true
+		c.decisionBranch = "pause"
+		*spntCom = c.controlOn
+		*pwrAtCom = 0
+	case "Charge Battery":
+		c.pauseActivated = false
+		c.decisionBranch = "charge"
+		if c.batteryControl == 0 {
+			c.zeroControl(spntCom, pwrAtCom, c.controlOn)
+			break
+		}
+		*spntCom = c.controlOn
+		*pwrAtCom = -int32(c.solarChargeLimit(c.batteryControl))
+	case "Discharge Battery":
+		c.pauseActivated = false
+		c.decisionBranch = "discharge"
+		if c.batteryControl == 0 {
+			c.zeroControl(spntCom, pwrAtCom, c.controlOn)
+			break
+		}
+		*spntCom = c.controlOn
+		*pwrAtCom = int32(c.batteryControl)
+	case "Balanced":
+		// Only send Balanced commands when Overwrite is actively set to Balanced; otherwise do nothing (no writes)
+		c.decisionBranch = "balanced"
+		if c.overwriteLogicSelection != "Balanced" {
+			c.decisionBranch = "balanced_ignored"
+			*spntCom = 0
+			*pwrAtCom = 0
+			c.logDebugf("Balanced logic ignored because we are in Automatic mode")
+			break
+		}
+		if c.balancedAlgorithm == "proportional" {
+			c.decisionBranch = "balanced_proportional"
+			c.applyBalancedProportional(spntCom, pwrAtCom)
+			break
+		}
+		// If battery_control is 0 (either just became 0 or stayed 0), treat as internal Automatic: by default do not send Modbus commands
+		if c.batteryControl == 0 {
+			c.zeroControl(spntCom, pwrAtCom, 0)
+			break
+		}
+		// Balanced logic (discharge-only commands) with dynamic battery_control adjustment, based on net grid (draw - feed):
+		// - If not importing and battery_discharge_power == 0: set battery_control to 0 and do not write (internal Automatic)
+		// - If importing: increase battery_control by balanced_gain × import (clamped) and discharge with that value
+		// - If exporting: decrease battery_control by balanced_gain × export; if <=0 set to 0 and do not write
+		// - Deviations within balanced_deadband_w, and setpoints within the deadband of the last written command, are not written
+		if c.inputs.netGrid <= 0 && c.inputs.batteryDischargePower == 0 {
+			c.decisionBranch = "balanced_idle"
+			c.setBatteryControl(0)
+			c.zeroControl(spntCom, pwrAtCom, 0)
+		} else if c.inputs.netGrid <= c.balancedDeadbandW && c.inputs.netGrid >= -c.balancedDeadbandW {
+			c.decisionBranch = "balanced_deadband"
+			*spntCom = 0
+			*pwrAtCom = 0
+		} else if c.inputs.netGrid > 0 {
+			c.decisionBranch = "balanced_import"
+			newBC := c.batteryControl + int(math.Round(c.balancedGain*float64(c.inputs.netGrid)))
+			if newBC > c.maximumBatteryControl {
+				newBC = c.maximumBatteryControl
+			}
+			c.setBatteryControl(newBC)
+			c.balancedCommand(newBC, spntCom, pwrAtCom)
+		} else if c.inputs.netGrid < 0 {
+			c.decisionBranch = "balanced_export"
+			newBC := c.batteryControl + int(math.Round(c.balancedGain*float64(c.inputs.netGrid)))
+			if newBC > 0 {
+				c.setBatteryControl(newBC)
+				c.balancedCommand(newBC, spntCom, pwrAtCom)
+			} else {
+				// Going to zero or below: set to 0 and apply the zero control policy (internal Automatic by default)
+				c.setBatteryControl(0)
+				c.zeroControl(spntCom, pwrAtCom, 0)
+			}
+		} else {
+			// Fallback: no decisive grid change detected, do not write
+			c.decisionBranch = "balanced_no_change"
+			*spntCom = 0
+			*pwrAtCom = 0
+		}
+	case "Clipping Charge":
+		c.pauseActivated = false
+		c.applyClippingCharge(spntCom, pwrAtCom)
+	case "Peak Shaving":
+		c.pauseActivated = false
+		c.applyPeakShaving(spntCom, pwrAtCom)
+	case "Schedule":
+		c.pauseActivated = false
+		c.applySchedule(spntCom, pwrAtCom)
+	case "Zero Export":
+		c.pauseActivated = false
+		c.applyZeroExport(spntCom, pwrAtCom)
+	default: // Automatic
+		c.pauseActivated = false
+		c.decisionBranch = "automatic"
+		*spntCom = c.controlOff
+		*pwrAtCom = 0
+	}
+	c.applySocLimits(mode, spntCom, pwrAtCom)
+}
+
+// pauseChargeOkRelease decides whether Pause (charge ok) releases control so the battery may charge:
+// when the feed-in exceeds pauseReleaseExportW and the battery is not discharging. While released,
+// evaluateControl keeps the release until the feed-in drops to pauseHoldExportW. A change waits until
+// the current state has lasted pauseMinDwellSeconds, except holding a discharging battery.
+func (c *Controller) pauseChargeOkRelease() bool {
+	release := c.inputs.netGrid < -c.pauseReleaseExportW && c.inputs.batteryDischargePower == 0
+	released := c.previousMode == "Pause (charge ok)" && !c.pauseActivated
+	if release == released {
+		return release
+	}
+	dwell := time.Duration(c.pauseMinDwellSeconds) * time.Second
+	if c.previousMode == "Pause (charge ok)" && time.Since(c.pauseToggledAt) < dwell && c.inputs.batteryDischargePower == 0 {
+		c.logDebugf("Pause (charge ok): keeping the current state for the minimum dwell time")
+		return released
+	}
+	c.pauseToggledAt = time.Now()
+	return release
+}
+
+// balancedCommand sets a legacy Balanced discharge command unless it is within balancedDeadbandW of
+// the discharge command already written, in which case nothing is written
+func (c *Controller) balancedCommand(value int, spntCom *uint32, pwrAtCom *int32) {
+	if c.lastSpntCom == c.controlOn && c.lastPwrAtCom > 0 {
+		diff := value - int(c.lastPwrAtCom)
+		if diff <= c.balancedDeadbandW && diff >= -c.balancedDeadbandW {
+			c.decisionBranch += "_deadband"
+			*spntCom = 0
+			*pwrAtCom = 0
+			return
+		}
+	}
+	*spntCom = c.controlOn
+	*pwrAtCom = int32(value)
+}
+
+// updateSocCeiling latches socCeilingReached at maximumSoc and releases it once the SOC has
+// dropped socHysteresis below the ceiling
+func (c *Controller) updateSocCeiling() {
+	if !c.inputs.batterySocKnown {
+		return
+	}
+	if c.inputs.batterySoc >= c.maximumSoc {
+		c.socCeilingReached = true
+	} else if c.inputs.batterySoc <= c.maximumSoc-c.socHysteresis {
+		c.socCeilingReached = false
+	}
+}
+
+// applySocLimits holds the battery at 0W instead of discharging in Discharge Battery, Balanced, Peak Shaving
+// and Schedule when the last SOC reading is at or below minimumSoc, and instead of charging in Charge Battery,
+// Balanced, Clipping Charge and Schedule while the SOC ceiling is reached. Without a SOC reading the command is allowed.
+func (c *Controller) applySocLimits(mode string, spntCom *uint32, pwrAtCom *int32) {
+	if *spntCom != c.controlOn || *pwrAtCom == 0 {
+		return
+	}
+	discharge := *pwrAtCom > 0 && (mode == "Discharge Battery" || mode == "Balanced" || mode == "Peak Shaving" || mode == "Schedule")
+	charge := *pwrAtCom < 0 && (mode == "Charge Battery" || mode == "Balanced" || mode == "Clipping Charge" || mode == "Schedule")
+	if !discharge && !charge {
+		return
+	}
+	if !c.inputs.batterySocKnown {
+		if !c.socUnknownWarned {
+			c.logWarnf("SOC unavailable, SOC limits (%d%%-%d%%) not enforced", c.minimumSoc, c.maximumSoc)
+			c.socUnknownWarned = true
+		}
+		return
+	}
+	c.socUnknownWarned = false
+	if discharge && c.inputs.batterySoc <= c.minimumSoc {
+		c.decisionBranch += "_soc_reserve"
+		*pwrAtCom = 0
+		c.logDebugf("SOC %d%% at or below minimum %d%%, discharge suppressed", c.inputs.batterySoc, c.minimumSoc)
+	}
+	c.updateSocCeiling()
+	if charge && c.socCeilingReached {
+		c.decisionBranch += "_soc_ceiling"
+		*pwrAtCom = 0
+		c.logDebugf("SOC %d%% reached maximum %d%%, charge suppressed until %d%%", c.inputs.batterySoc, c.maximumSoc, c.maximumSoc-c.socHysteresis)
+	}
+}
+
+// applyClippingCharge charges the battery only with PV power that would otherwise be clipped.
+// excess = dc1_power + dc2_power - ac_power - battery_charge + battery_discharge is the DC power reaching
+// neither the AC side nor the battery (the battery is DC-coupled, so its own charging is not excess).
+// With AC pinned within clippingMarginW of the AC limit, or while already charging, the setpoint holds
+// AC at the limit less the margin: the current charge plus the excess, raised while AC is above that
+// level and lowered while it is below, so it settles on the clipped power and drops to 0 once PV falls
+// below the limit. Otherwise excess above the margin is charged, and without clipping the battery is
+// held at 0W.
+func (c *Controller) applyClippingCharge(spntCom *uint32, pwrAtCom *int32) {
+	in := c.inputs
+	excess := in.dc1Power + in.dc2Power - in.acPower - in.batteryChargePower + in.batteryDischargePower
+	if excess < 0 {
+		excess = 0
+	}
+	charge := 0
+	threshold := c.inverterAcLimitW - c.clippingMarginW
+	if c.inverterAcLimitW > 0 && (in.acPower >= threshold || in.batteryChargePower > 0) {
+		c.decisionBranch = "clipping_pinned"
+		charge = in.batteryChargePower - in.batteryDischargePower + excess + in.acPower - threshold
+		if charge < 0 {
+			charge = 0
+		}
+	} else if excess > c.clippingMarginW {
+		c.decisionBranch = "clipping_excess"
+		charge = excess
+	} else {
+		c.decisionBranch = "clipping_none"
+	}
+	if charge > c.maximumBatteryControl {
+		charge = c.maximumBatteryControl
+	}
+	*spntCom = c.controlOn
+	*pwrAtCom = -int32(charge)
+	c.logDebugf("Clipping Charge: AC %dW, DC excess %dW → charge %dW", in.acPower, excess, charge)
+}
+
+// applyPeakShaving discharges the battery by the grid import above peakShaveLimitW. The current
+// battery flow is added back so the setpoint is the discharge that holds the import at the limit;
+// once no discharge is needed the inverter is released to its internal logic.
+func (c *Controller) applyPeakShaving(spntCom *uint32, pwrAtCom *int32) {
+	discharge := c.inputs.batteryDischargePower - c.inputs.batteryChargePower + c.inputs.netGrid - c.inputs.peakShaveLimitW
+	if discharge <= 0 {
+		c.decisionBranch = "peak_shaving_idle"
+		*pwrAtCom = 0
+		*spntCom = c.controlOff
+		if c.lastSpntCom == c.controlOff {
+			// Already released; avoid repeating the write every cycle
+			*spntCom = 0
+		}
+		return
+	}
+	c.decisionBranch = "peak_shaving_discharge"
+	if discharge > c.maximumBatteryControl {
+		discharge = c.maximumBatteryControl
+	}
+	*spntCom = c.controlOn
+	*pwrAtCom = int32(discharge)
+	c.logDebugf("Peak Shaving: net grid %dW, limit %dW → discharge %dW", c.inputs.netGrid, c.inputs.peakShaveLimitW, discharge)
+}
+
+// applyZeroExport charges the battery with the power that would otherwise be fed into the grid:
+// charge = battery_charge - battery_discharge - net_grid, up to maximumBatteryControl.
+// Without feed-in the inverter is released to its internal logic. While the SOC ceiling is reached the
+// battery cannot take the surplus: control is released and PV is curtailed through
+// zeroExportLimitRegister. Without that register feed-in cannot be prevented, which is logged as an error.
+func (c *Controller) applyZeroExport(spntCom *uint32, pwrAtCom *int32) {
+	c.updateSocCeiling()
+	full := c.socCeilingReached
+	if full != c.zeroExportFull {
+		c.zeroExportFull = full
+		if !full {
+			c.logInfof("Zero Export: SOC %d%% below the ceiling again, charging from feed-in", c.inputs.batterySoc)
+		} else if c.zeroExportLimitRegister != 0 {
+			c.logInfof("Zero Export: SOC %d%% reached maximum %d%%, curtailing PV through register %d", c.inputs.batterySoc, c.maximumSoc, c.zeroExportLimitRegister)
+		} else {
+			c.logErrorf("Zero Export: SOC %d%% reached maximum %d%% and ZERO_EXPORT_LIMIT_REGISTER is not set, surplus PV will be fed into the grid", c.inputs.batterySoc, c.maximumSoc)
+		}
+	}
+	if full {
+		c.curtailForZeroExport()
+	} else {
+		c.restorePvLimit()
+	}
+	charge := c.inputs.batteryChargePower - c.inputs.batteryDischargePower - c.inputs.netGrid
+	if full || charge <= 0 {
+		c.decisionBranch = "zero_export_idle"
+		if full {
+			c.decisionBranch = "zero_export_full"
+			if c.pvLimitW >= 0 {
+				c.decisionBranch = "zero_export_curtailed"
+			}
+		}
+		*pwrAtCom = 0
+		*spntCom = c.controlOff
+		if c.lastSpntCom == c.controlOff {
+			// Already released; avoid repeating the write every cycle
+			*spntCom = 0
+		}
+		return
+	}
+	c.decisionBranch = "zero_export_charge"
+	if charge > c.maximumBatteryControl {
+		charge = c.maximumBatteryControl
+	}
+	*spntCom = c.controlOn
+	*pwrAtCom = -int32(charge)
+	c.logDebugf("Zero Export: net grid %dW → charge %dW", c.inputs.netGrid, charge)
 }
 
-func setupModbus() {
-	log.Printf("Setting up modbus")
-	// Create Modbus TCP client handler
-	handler := modbus.NewTCPClientHandler(
-		fmt.Sprintf("%s:%s",
-			getEnv("SMA_INVERTER_MODBUS_ADDRESS", "192.168.1.100"),
-			getEnv("SMA_INVERTER_MODBUS_PORT", "502")),
-	)
-	handler.Timeout = 10 * time.Second
-	handler.SlaveId = 3 // SMA inverter Modbus slave ID
-
-	// Connect to Modbus device
-	modbusMu.Lock()
-	err := handler.Connect()
-	if err != nil {
-		modbusMu.Unlock()
-		log.Fatalf("Modbus connection error: %v", err)
+// curtailForZeroExport limits the inverter's active power to the AC output the house consumes
+// (ac_power + net_grid) while Zero Export cannot charge. Changes within minWriteDeltaW are not written.
+func (c *Controller) curtailForZeroExport() {
+	if c.zeroExportLimitRegister == 0 {
+		return
 	}
-	modbusClient = modbus.NewClient(handler)
-	modbusMu.Unlock()
-	currentTime := time.Now()
-	timeDiff := currentTime.Sub(modbusClientErrorTime)
-	if timeDiff > 30*time.Minute {
-		modbusClientErrorCount = 0
+	limit := c.inputs.acPower + c.inputs.netGrid
+	if limit < 0 {
+		limit = 0
+	} else if limit > c.inverterAcLimitW {
+		limit = c.inverterAcLimitW
+	}
+	if diff := limit - c.pvLimitW; c.pvLimitW >= 0 && diff <= c.minWriteDeltaW && diff >= -c.minWriteDeltaW {
+		return
+	}
+	if c.writePvLimit(limit) {
+		c.logDebugf("Zero Export: AC %dW, net grid %dW → active power limit %dW", c.inputs.acPower, c.inputs.netGrid, limit)
+		c.pvLimitW = limit
 	}
 }
 
-// Static list of polled input registers (2 words each)
-var polledRegisters = []regDef{
-	{"battery_status", 31391},
-	{"battery_soc", 30845},
-	{"battery_temperature", 30849},
-	{"battery_diagnose_current_capacity", 30847},
-	{"battery_charge_power", 31393},
-	{"battery_discharge_power", 31395},
-	{"dc1_current", 30769},
-	{"dc1_voltage", 30771},
-	{"dc1_power", 30773},
-	{"dc2_current", 30957},
-	{"dc2_voltage", 30959},
-	{"dc2_power", 30961},
-	{"ac_power", 30775},
-	{"grid_feed", 30867},
-	{"grid_draw", 30865},
-	{"inverter_temperature", 30953},
-}
-
-func modbusReadLoop() {
-	// Normal polling ticker and a fast 1s ticker used while in Balanced mode
-	normalTicker := time.NewTicker(time.Duration(modbusIntervalInSeconds) * time.Second)
-	fastTicker := time.NewTicker(1 * time.Second)
-	resetTicker := time.NewTicker(time.Duration(resetIntervalMinutes) * time.Minute) // periodic control logic check
-	fullPublishTicker := time.NewTicker(30 * time.Minute)                            // force full sensor publish every 30 minutes
-	for {
-		select {
-		case <-fastTicker.C:
-			// When Balanced overwrite is active, poll every second for quick reactions
-			if overwriteLogicSelection == "Balanced" {
-				readAndPublishData()
-				checkPauseChargeOkMode()
-			}
-		case <-normalTicker.C:
-			// In non-Balanced modes, poll at the configured interval
-			if overwriteLogicSelection != "Balanced" {
-				readAndPublishData()
-				checkPauseChargeOkMode()
-			}
-		case <-resetTicker.C:
-			applyControlLogic()
-		case <-fullPublishTicker.C:
-			// Clear cache to force publish of all sensors, then read and publish immediately
-			lastSensorValues = make(map[string]string, len(polledRegisters)+1)
-			readAndPublishData()
-		}
+// restorePvLimit writes inverterAcLimitW back to zeroExportLimitRegister once Zero Export curtailment ends
+func (c *Controller) restorePvLimit() {
+	if c.pvLimitW < 0 {
+		return
+	}
+	if c.writePvLimit(c.inverterAcLimitW) {
+		c.logInfof("Zero Export: PV curtailment ended, active power limit restored to %dW", c.inverterAcLimitW)
+		c.pvLimitW = -1
 	}
 }
 
-func readAndPublishData() {
-	for _, r := range polledRegisters {
-		modbusMu.Lock()
-		result, err := modbusClient.ReadInputRegisters(r.addr, 2)
-		modbusMu.Unlock()
-		if err != nil {
-			if debugEnabled {
-				log.Printf("Error reading %s register: %v", r.name, err)
-			}
-			modbusClientErrorCount++
-			modbusClientErrorTime = time.Now()
-			if modbusClientErrorCount < 20 {
-				log.Printf("Trying to reconnect because of %v", err)
-				time.Sleep(30 * time.Second)
-				setupModbus()
-			} else if modbusClientErrorCount > 20 {
-				fmt.Fprintf(os.Stderr, "error: %v\n", err)
-				os.Exit(1)
-			}
-			continue
-		}
-		value := int32(binary.BigEndian.Uint32(result))
-		valueFloat := float32(value)
-
-		// Update control variables and apply scaling
-		switch r.name {
-		case "dc1_current", "dc2_current":
-			valueFloat = valueFloat * 0.001
-		case "dc1_voltage", "dc2_voltage":
-			valueFloat = valueFloat * 0.01
-		case "battery_temperature":
-			valueFloat = valueFloat * 0.1
-		case "inverter_temperature":
-			valueFloat = valueFloat * 0.01
-		case "battery_discharge_power":
-			batteryDischargePower = int(value)
-		case "battery_charge_power":
-			batteryChargePower = int(value)
-		case "ac_power":
-			acPower = int(value)
-		case "grid_feed":
-			gridFeed = int(value)
-		case "grid_draw":
-			gridDraw = int(value)
-		}
+// writePvLimit writes an active power limit (W) to zeroExportLimitRegister
+func (c *Controller) writePvLimit(watts int) bool {
+	if c.dryRun {
+		c.logInfof("Dry run: would write active power limit %dW to register %d", watts, c.zeroExportLimitRegister)
+		return true
+	}
+	c.modbusMu.Lock()
+	defer c.modbusMu.Unlock()
+	return c.writeRegister(c.zeroExportLimitRegister, uint32ToBytes(uint32(watts)))
+}
 
-		// Build payload string efficiently and publish only if changed
-		var payloadStr string
-		if int32(valueFloat) != value {
-			// format float with trimming to avoid noisy changes
-			payloadStr = strconv.FormatFloat(float64(valueFloat), 'f', 2, 64)
+// applySchedule applies the action of the schedule window active now: charge or discharge with the
+// window's power (battery_control if unset) or pause at 0W. Outside all windows the inverter is
+// released to its internal logic.
+func (c *Controller) applySchedule(spntCom *uint32, pwrAtCom *int32) {
+	index := c.activeScheduleWindow()
+	if index != c.lastScheduleWindow {
+		if index < 0 {
+			c.logInfof("Schedule: no active window")
 		} else {
-			payloadStr = strconv.FormatInt(int64(value), 10)
+			w := c.scheduleWindows[index]
+			c.logInfof("Schedule: window %s-%s active, %s", w.Start, w.End, w.Action)
 		}
-		stateTopic := sensorTopicPrefix + r.name + "/state"
-		if last, ok := lastSensorValues[r.name]; !ok || last != payloadStr {
-			lastSensorValues[r.name] = payloadStr
-			mqttPublish(stateTopic, []byte(payloadStr), false)
+	}
+	c.lastScheduleWindow = index
+	if index < 0 {
+		c.decisionBranch = "schedule_idle"
+		*pwrAtCom = 0
+		*spntCom = c.controlOff
+		if c.lastSpntCom == c.controlOff {
+			// Already released; avoid repeating the write every cycle
+			*spntCom = 0
 		}
+		return
 	}
-
-	// Publish modbus error count
-	stateTopic := sensorTopicPrefix + "modbus_error_count/state"
-	payload := strconv.FormatInt(int64(modbusClientErrorCount), 10)
-	if last, ok := lastSensorValues["modbus_error_count"]; !ok || last != payload {
-		lastSensorValues["modbus_error_count"] = payload
-		mqttPublish(stateTopic, []byte(payload), false)
+	w := c.scheduleWindows[index]
+	power := w.Power
+	if power <= 0 {
+		power = c.batteryControl
+	}
+	if power > c.maximumBatteryControl {
+		power = c.maximumBatteryControl
+	}
+	c.decisionBranch = "schedule_" + w.Action
+	*spntCom = c.controlOn
+	switch w.Action {
+	case "charge":
+		*pwrAtCom = -int32(power)
+	case "discharge":
+		*pwrAtCom = int32(power)
+	default: // pause
+		*pwrAtCom = 0
 	}
 }
 
-func checkPauseChargeOkMode() {
-	var currentMode string
-	if overwriteLogicSelection != "Off" {
-		currentMode = overwriteLogicSelection
+// applyBalancedProportional drives net grid import (grid_draw - grid_feed) toward zero. The signed
+// setpoint (positive = discharge, negative = charge) moves by balancedGain × error whenever the error
+// is outside the deadband, clamped to ±maximumBatteryControl; battery_control shows its magnitude.
+func (c *Controller) applyBalancedProportional(spntCom *uint32, pwrAtCom *int32) {
+	if c.previousMode != "Balanced" {
+		c.balancedSetpoint = c.batteryControl
+	}
+	if c.inputs.netGrid > c.balancedDeadbandW || c.inputs.netGrid < -c.balancedDeadbandW {
+		c.balancedSetpoint += int(math.Round(c.balancedGain * float64(c.inputs.netGrid)))
+		if c.balancedSetpoint > c.maximumBatteryControl {
+			c.balancedSetpoint = c.maximumBatteryControl
+		} else if c.balancedSetpoint < -c.maximumBatteryControl {
+			c.balancedSetpoint = -c.maximumBatteryControl
+		}
+	}
+	if c.balancedSetpoint < 0 {
+		c.setBatteryControl(-c.balancedSetpoint)
 	} else {
-		currentMode = automaticLogicSelection
+		c.setBatteryControl(c.balancedSetpoint)
 	}
-	// Continuously react in Balanced only when Overwrite is actively set to Balanced (not in Automatic mode)
-	if overwriteLogicSelection == "Balanced" {
-		applyControlLogic()
+	if c.balancedSetpoint == 0 {
+		c.zeroControl(spntCom, pwrAtCom, 0)
 		return
 	}
-	if currentMode == "Pause (charge ok)" && !pauseActivated && batteryDischargePower > 0 {
-		applyControlLogic()
-	}
+	*spntCom = c.controlOn
+	*pwrAtCom = int32(c.balancedSetpoint)
+	c.logDebugf("Balanced (proportional): net grid %dW → setpoint %dW", c.inputs.netGrid, c.balancedSetpoint)
 }
 
-func applyControlLogic() {
-	controlMu.Lock()
-	defer controlMu.Unlock()
-	var spntCom uint32 = 0
-	var pwrAtCom int32 = 0
-	var currentMode string
-
-	if overwriteLogicSelection != "Off" {
-		currentMode = overwriteLogicSelection
-	} else {
-		currentMode = automaticLogicSelection
-	}
-
-	if currentMode != currentLogicSelection {
-		currentLogicSelection = currentMode
-		// Publish current logic selection as a read-only sensor state
-		stateTopic := fmt.Sprintf("homeassistant/sensor/%s/current_logic_selection/state", deviceID)
-		mqttPublish(stateTopic, []byte(currentLogicSelection), true)
+// returnFromBalanced resets battery_control according to BALANCED_RETURN_SETPOINT after Balanced
+// deactivates: "hold" keeps the adjusted value, "restore" the value from before Balanced,
+// "default" 90% of maximum_battery_control
+func (c *Controller) returnFromBalanced() {
+	switch c.balancedReturnSetpoint {
+	case "restore":
+		c.setBatteryControl(c.balancedEntryBatteryControl)
+	case "default":
+		c.setBatteryControl(int(math.Round(float64(c.maximumBatteryControl) * 0.90)))
+	default: // hold
+		return
 	}
+	c.logInfof("Left Balanced, battery_control set to %dW (%s)", c.batteryControl, c.balancedReturnSetpoint)
+}
 
-	// Only apply control logic if mode has changed or not in "Automatic" mode
-	if currentMode != previousMode || (currentMode != "Automatic" && !(currentMode == "Pause (charge ok)" && !pauseActivated && gridFeed > 50 && batteryDischargePower == 0)) {
-		//if debugEnabled {
-		log.Printf("Applying control logic: Mode=%s", currentMode)
-		//}
-		applyMode(currentMode, &spntCom, &pwrAtCom)
-	} else {
-		// In "Automatic" mode and mode has not changed, do not send commands
+// setBatteryControl updates battery_control from the control logic and publishes it if it changed
+func (c *Controller) setBatteryControl(value int) {
+	if value == c.batteryControl {
 		return
 	}
+	c.batteryControl = value
+	c.lastValidBatteryControl = value
+	stateTopic := fmt.Sprintf("%s/number/%s/%s/state", c.discoveryPrefix, c.deviceID, "battery_control")
+	c.mqttPublish(stateTopic, []byte(strconv.Itoa(value)), true)
+}
 
-	previousMode = currentMode
+// regWrite is a single holding register write issued by writeControlCommands
+type regWrite struct {
+	addr uint16
+	data []byte
+}
 
-	if spntCom != 0 {
-		// Write control commands to Modbus
-		writeControlCommands(spntCom, pwrAtCom)
-		// Give inverter a brief moment to apply new settings before reading back
-		// In Balanced mode we must react quickly based on grid values: skip the post_command delay
-		if currentMode != "Balanced" {
-			time.Sleep(time.Duration(postCommandDelayMs) * time.Millisecond)
+// writeControlCommands writes the command unless it repeats the last written one (same control
+// method, power within minWriteDeltaW) less than minWriteIntervalMs after the last write, which
+// protects the inverter from a stream of holding-register writes. It reports whether the command was
+// written successfully.
+func (c *Controller) writeControlCommands(spntCom uint32, pwrAtCom int32) bool {
+	if c.minWriteIntervalMs > 0 && !c.lastWriteFailed && !c.lastWriteAt.IsZero() &&
+		time.Since(c.lastWriteAt) < time.Duration(c.minWriteIntervalMs)*time.Millisecond {
+		diff := int(pwrAtCom) - int(c.lastPwrAtCom)
+		if spntCom == c.lastSpntCom && diff <= c.minWriteDeltaW && diff >= -c.minWriteDeltaW {
+			c.logDebugf("Skipping control command SpntCom=%d, PwrAtCom=%d: last write %dms ago", spntCom, pwrAtCom, time.Since(c.lastWriteAt).Milliseconds())
+			return false
 		}
 	}
-	// Always read and publish after evaluating/applying control changes
-	readAndPublishData()
+	c.sendControlCommands(spntCom, pwrAtCom)
+	return !c.lastWriteFailed
 }
 
-func applyMode(mode string, spntCom *uint32, pwrAtCom *int32) {
-	const (
-		controlOn  uint32 = 802
-		controlOff uint32 = 803
-	)
-
-	switch mode {
-	case "Pause (charge ok)":
-		*spntCom = controlOn
-		if gridFeed > 100 && batteryDischargePower == 0 {
-			pauseActivated = false
-			// Allow charging up to the specified battery control value
-			*spntCom = controlOff
-			*pwrAtCom = 0
-			if debugEnabled {
-				log.Println("We are supplying Power, disable control")
-			}
-		} else {
-			pauseActivated = true
-			// if we supply energy to the grid, turn on charging
-			*pwrAtCom = 0
-			if debugEnabled {
-				log.Println("Battery is discharging, setting power command to 0W")
-			}
+// sendControlCommands writes the control method and power command registers
+func (c *Controller) sendControlCommands(spntCom uint32, pwrAtCom int32) {
+	c.modbusMu.Lock()
+	defer c.modbusMu.Unlock()
+	// Communication control (40151) and power command (40149) by default
+	writes := []regWrite{
+		{c.controlRegister, uint32ToBytes(spntCom)},
+		{c.powerRegister, int32ToBytes(pwrAtCom)},
+	}
+	if c.writeOrder == "power_first" {
+		writes[0], writes[1] = writes[1], writes[0]
+	}
+	// Combine adjacent registers into one atomic write when enabled; separate writes otherwise
+	if c.combinedControlWrite {
+		lo, hi := writes[0], writes[1]
+		if hi.addr < lo.addr {
+			lo, hi = hi, lo
 		}
-	case "Pause":
-		pauseActivated = true
-		*spntCom = controlOn
-		*pwrAtCom = 0
-	case "Charge Battery":
-		pauseActivated = false
-		*spntCom = controlOn
-		*pwrAtCom = -int32(batteryControl)
-	case "Discharge Battery":
-		pauseActivated = false
-		*spntCom = controlOn
-		*pwrAtCom = int32(batteryControl)
-	case "Balanced":
-		// Only send Balanced commands when Overwrite is actively set to Balanced; otherwise do nothing (no writes)
-		if overwriteLogicSelection != "Balanced" {
-			*spntCom = 0
-			*pwrAtCom = 0
-			if debugEnabled {
-				log.Println("Balanced logic ignored because we are in Automatic mode")
-			}
-			break
+		if lo.addr+uint16(len(lo.data)/2) == hi.addr {
+			writes = []regWrite{{lo.addr, append(append([]byte{}, lo.data...), hi.data...)}}
+		} else {
+			c.logDebugf("Control registers %d and %d are not adjacent, writing separately", lo.addr, hi.addr)
 		}
-		// If battery_control is 0 (either just became 0 or stayed 0), treat as internal Automatic: do not send Modbus commands
-		if batteryControl == 0 {
-			*spntCom = 0
-			*pwrAtCom = 0
-			if debugEnabled {
-				log.Println("Balanced: battery_control is 0 → internal Automatic, no Modbus commands")
-			}
-			break
+	}
+	if c.debugRawWrites {
+		c.publishRawWrites(spntCom, pwrAtCom, writes)
+	}
+	if c.dryRun {
+		for _, w := range writes {
+			c.logInfof("Dry run: would write register %d: %v", w.addr, w.data)
 		}
-		// Balanced logic (discharge-only commands) with dynamic battery_control adjustment:
-		// - If grid_draw == 0 and battery_discharge_power == 0: set battery_control to 0 and do not write (internal Automatic)
-		// - If grid_draw > 0: increase battery_control by grid_draw (clamped) and discharge with that value
-		// - If grid_draw == 0 and grid_feed > 0: decrease battery_control by grid_feed; if <=0 set to 0 and do not write
-		if gridDraw == 0 && batteryDischargePower == 0 {
-			if batteryControl != 0 {
-				batteryControl = 0
-				lastValidBatteryControl = 0
-				stateTopic := fmt.Sprintf("homeassistant/number/%s/%s/state", deviceID, "battery_control")
-				mqttPublish(stateTopic, []byte("0"), true)
+	} else {
+		for i, w := range writes {
+			if i > 0 {
+				time.Sleep(100 * time.Millisecond)
 			}
-			*spntCom = 0
-			*pwrAtCom = 0
-		} else if gridDraw > 0 {
-			newBC := batteryControl + gridDraw
-			if newBC > maximumBatteryControl {
-				newBC = maximumBatteryControl
-			}
-			if newBC != batteryControl {
-				batteryControl = newBC
-				lastValidBatteryControl = newBC
-				stateTopic := fmt.Sprintf("homeassistant/number/%s/%s/state", deviceID, "battery_control")
-				mqttPublish(stateTopic, []byte(strconv.Itoa(newBC)), true)
-			}
-			*spntCom = controlOn
-			*pwrAtCom = int32(newBC)
-		} else if gridFeed > 0 { // gridDraw == 0 implied here
-			newBC := batteryControl - gridFeed
-			if newBC > 0 {
-				if newBC != batteryControl {
-					batteryControl = newBC
-					lastValidBatteryControl = newBC
-					stateTopic := fmt.Sprintf("homeassistant/number/%s/%s/state", deviceID, "battery_control")
-					mqttPublish(stateTopic, []byte(strconv.Itoa(newBC)), true)
-				}
-				*spntCom = controlOn
-				*pwrAtCom = int32(newBC)
-			} else {
-				// Going to zero or below: set to 0 and do not write (internal Automatic)
-				if batteryControl != 0 {
-					batteryControl = 0
-					lastValidBatteryControl = 0
-					stateTopic := fmt.Sprintf("homeassistant/number/%s/%s/state", deviceID, "battery_control")
-					mqttPublish(stateTopic, []byte("0"), true)
-				}
-				*spntCom = 0
-				*pwrAtCom = 0
+			if !c.writeRegister(w.addr, w.data) {
+				return
 			}
+		}
+	}
+	c.lastWriteFailed = false
+	c.lastWriteAt = time.Now()
+	if spntCom != c.lastSpntCom {
+		c.lastControlChange = time.Now()
+	}
+	c.lastSpntCom = spntCom
+	c.lastPwrAtCom = pwrAtCom
+	if c.dryRun {
+		c.logInfof("Dry run: control command not sent: SpntCom=%d, PwrAtCom=%d", spntCom, pwrAtCom)
+		return
+	}
+	c.logDebugf("Control command sent: SpntCom=%d, PwrAtCom=%d", spntCom, pwrAtCom)
+}
+
+// verifyControlWrite reads the control and power registers back and rewrites the command up to
+// writeReadbackRetries times while the inverter reports different values. Returns whether the
+// command was confirmed, and current = false when a newer command replaced it during the check.
+// Called without controlMu; it is only taken for the rewrite.
+func (c *Controller) verifyControlWrite(spntCom uint32, pwrAtCom int32) (confirmed, current bool) {
+	for attempt := 0; ; attempt++ {
+		readSpntCom, err := c.readHoldingUint32(c.controlRegister)
+		var readPower uint32
+		if err == nil {
+			readPower, err = c.readHoldingUint32(c.powerRegister)
+		}
+		if err != nil {
+			c.logWarnf("Error reading back control registers: %v", err)
 		} else {
-			// Fallback: no decisive grid change detected, do not write
-			*spntCom = 0
-			*pwrAtCom = 0
+			readPwrAtCom := int32(readPower)
+			if readSpntCom == spntCom && readPwrAtCom == pwrAtCom {
+				c.logDebugf("Control command confirmed: SpntCom=%d, PwrAtCom=%d", spntCom, pwrAtCom)
+				return true, true
+			}
+			c.logWarnf("Control readback SpntCom=%d, PwrAtCom=%d does not match written %d, %d", readSpntCom, readPwrAtCom, spntCom, pwrAtCom)
 		}
-	default: // Automatic
-		pauseActivated = false
-		*spntCom = controlOff
-		*pwrAtCom = 0
+		if attempt >= c.writeReadbackRetries {
+			c.logErrorf("Control command SpntCom=%d, PwrAtCom=%d not confirmed after %d retries", spntCom, pwrAtCom, c.writeReadbackRetries)
+			return false, true
+		}
+		c.controlMu.Lock()
+		if c.lastSpntCom != spntCom || c.lastPwrAtCom != pwrAtCom {
+			// A newer command was written meanwhile and gets its own read-back
+			c.controlMu.Unlock()
+			return false, false
+		}
+		c.sendControlCommands(spntCom, pwrAtCom)
+		failed := c.lastWriteFailed
+		c.controlMu.Unlock()
+		if failed {
+			return false, true
+		}
+		time.Sleep(time.Duration(c.postCommandDelayMs) * time.Millisecond)
 	}
 }
 
-func writeControlCommands(spntCom uint32, pwrAtCom int32) {
-	modbusMu.Lock()
-	defer modbusMu.Unlock()
-	// Write to register 40151 (Communication control)
-	spntComData := uint32ToBytes(spntCom)
-	if debugEnabled {
-		log.Printf("Writing to register 40151: %v", spntComData)
+// readControlMethod reads the current value of the communication control register (40151)
+func (c *Controller) readControlMethod() (uint32, error) {
+	return c.readHoldingUint32(c.controlRegister)
+}
+
+// readInitialControlMethod reads 40151 once for AUTOMATIC_INITIAL_WRITE=readback, so the first
+// Automatic evaluation can use it without a Modbus read of its own. Runs on the read loop before
+// its first poll; an evaluation deferred until then is run right away.
+func (c *Controller) readInitialControlMethod() {
+	method, err := c.readControlMethod()
+	c.controlMu.Lock()
+	c.initialControlMethod, c.initialControlMethodErr = method, err
+	c.initialControlMethodRead = true
+	deferred := c.controlDeferred
+	c.controlDeferred = false
+	c.controlMu.Unlock()
+	if deferred {
+		c.applyControlLogic()
 	}
-	_, err := modbusClient.WriteMultipleRegisters(40151, 2, spntComData)
+}
+
+// readHoldingUint32 reads the 32-bit holding register at addr
+func (c *Controller) readHoldingUint32(addr uint16) (uint32, error) {
+	c.modbusMu.Lock()
+	defer c.modbusMu.Unlock()
+	result, err := c.modbusClient.ReadHoldingRegisters(addr, 2)
 	if err != nil {
-		log.Printf("Error writing to register 40151: %v", err)
-		modbusClientErrorCount++
-		modbusClientErrorTime = time.Now()
-		if modbusClientErrorCount < 5 {
-			time.Sleep(30 * time.Second)
-			setupModbus()
-		} else {
-			log.Fatalf("To many modbus errors, have to terminate %v", err)
-		}
-		return
+		return 0, err
 	}
-	time.Sleep(100 * time.Millisecond)
+	return binary.BigEndian.Uint32(result), nil
+}
 
-	// Write to register 40149 (Power command)
-	pwrAtComData := int32ToBytes(pwrAtCom)
-	if debugEnabled {
-		log.Printf("Writing to register 40149: %v", pwrAtComData)
+// publishRawWrites logs and publishes the exact bytes about to be written, with the decoded values,
+// to <deviceID>/debug/raw_write for diagnosing byte-order issues on the write side
+func (c *Controller) publishRawWrites(spntCom uint32, pwrAtCom int32, writes []regWrite) {
+	type rawWrite struct {
+		Register uint16 `json:"register"`
+		Bytes    string `json:"bytes"`
 	}
-	_, err = modbusClient.WriteMultipleRegisters(40149, 2, pwrAtComData)
+	payload := struct {
+		SpntCom  uint32     `json:"spnt_com"`
+		PwrAtCom int32      `json:"pwr_at_com"`
+		Writes   []rawWrite `json:"writes"`
+	}{SpntCom: spntCom, PwrAtCom: pwrAtCom}
+	for _, w := range writes {
+		payload.Writes = append(payload.Writes, rawWrite{w.addr, fmt.Sprintf("% x", w.data)})
+		c.logInfof("Raw write %d: % x (SpntCom=%d, PwrAtCom=%d)", w.addr, w.data, spntCom, pwrAtCom)
+	}
+	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error writing to register 40149: %v", err)
-		modbusClientErrorCount++
-		modbusClientErrorTime = time.Now()
-		if modbusClientErrorCount < 5 {
-			time.Sleep(30 * time.Second)
-			setupModbus()
-		} else {
-			log.Fatalf("To many modbus errors, have to terminate %v", err)
-		}
+		c.logErrorf("Error marshaling raw write payload: %v", err)
 		return
 	}
-	if debugEnabled {
-		log.Printf("Control command sent: SpntCom=%d, PwrAtCom=%d", spntCom, pwrAtCom)
+	c.mqttPublish(c.deviceID+"/debug/raw_write", payloadBytes, false)
+}
+
+// writeRegister writes len(data)/2 registers starting at addr and handles errors; caller must hold modbusMu
+func (c *Controller) writeRegister(addr uint16, data []byte) bool {
+	c.logDebugf("Writing to register %d: %v", addr, data)
+	_, err := c.modbusClient.WriteMultipleRegisters(addr, uint16(len(data)/2), data)
+	if err != nil {
+		c.logErrorf("Error writing to register %d: %v", addr, err)
+		metricWriteErrors.WithLabelValues(c.deviceID).Inc()
+		c.countModbusError()
+		c.modbusLastError = err
+		c.lastWriteFailed = true
+		// The read loop reconnects before the next poll; reconnecting here would block with modbusMu held
+		c.modbusReconnecting = true
+		c.publishControllerStatus()
+		return false
 	}
+	return true
 }
 
-func loadInitialSettings() {
-	stateTopic := fmt.Sprintf("homeassistant/select/%s/automatic_logic_selection/state", deviceID)
-	mqttClient.Subscribe(stateTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
-		automaticLogicSelection = string(msg.Payload())
-		if debugEnabled {
-			log.Printf("Loaded automatic_logic_selection from MQTT: %s", automaticLogicSelection)
+func (c *Controller) loadInitialSettings() {
+	// The bootstrap subscriptions are dropped again after the startup wait
+	var bootstrapTopics []string
+	stateTopic := fmt.Sprintf("%s/select/%s/automatic_logic_selection/state", c.discoveryPrefix, c.deviceID)
+	bootstrapTopics = append(bootstrapTopics, stateTopic)
+	c.mqttClient.Subscribe(stateTopic, c.mqttQos, func(client mqtt.Client, msg mqtt.Message) {
+		c.controlMu.Lock()
+		c.automaticLogicSelection = string(msg.Payload())
+		c.controlMu.Unlock()
+		c.signalRestored("automatic_logic_selection")
+		c.logDebugf("Loaded automatic_logic_selection from MQTT: %s", msg.Payload())
+	})
+
+	stateTopic = fmt.Sprintf("%s/select/%s/overwrite_logic_selection/state", c.discoveryPrefix, c.deviceID)
+	bootstrapTopics = append(bootstrapTopics, stateTopic)
+	c.mqttClient.Subscribe(stateTopic, c.mqttQos, func(client mqtt.Client, msg mqtt.Message) {
+		c.controlMu.Lock()
+		c.overwriteLogicSelection = string(msg.Payload())
+		c.controlMu.Unlock()
+		c.signalRestored("overwrite_logic_selection")
+		c.logDebugf("Loaded overwrite_logic_selection from MQTT: %s", msg.Payload())
+	})
+
+	stateTopic = fmt.Sprintf("%s/number/%s/battery_control/state", c.discoveryPrefix, c.deviceID)
+	bootstrapTopics = append(bootstrapTopics, stateTopic)
+	c.mqttClient.Subscribe(stateTopic, c.mqttQos, func(client mqtt.Client, msg mqtt.Message) {
+		value, err := strconv.Atoi(string(msg.Payload()))
+		if err == nil {
+			c.controlMu.Lock()
+			c.batteryControl = value
+			c.lastValidBatteryControl = value
+			c.controlMu.Unlock()
+			c.signalRestored("battery_control")
 		}
+		c.logDebugf("Loaded battery_control from MQTT: %s", msg.Payload())
 	})
 
-	stateTopic = fmt.Sprintf("homeassistant/select/%s/overwrite_logic_selection/state", deviceID)
-	mqttClient.Subscribe(stateTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
-		overwriteLogicSelection = string(msg.Payload())
-		if debugEnabled {
-			log.Printf("Loaded overwrite_logic_selection from MQTT: %s", overwriteLogicSelection)
+	// A minimum SOC set from Home Assistant overrides the configured value
+	stateTopic = fmt.Sprintf("%s/number/%s/minimum_soc/state", c.discoveryPrefix, c.deviceID)
+	bootstrapTopics = append(bootstrapTopics, stateTopic)
+	c.mqttClient.Subscribe(stateTopic, c.mqttQos, func(client mqtt.Client, msg mqtt.Message) {
+		value, err := strconv.Atoi(string(msg.Payload()))
+		if err == nil && value >= 0 && value <= 100 {
+			c.controlMu.Lock()
+			c.minimumSoc = value
+			c.controlMu.Unlock()
+			c.signalRestored("minimum_soc")
 		}
+		c.logDebugf("Loaded minimum_soc from MQTT: %s", msg.Payload())
 	})
 
-	stateTopic = fmt.Sprintf("homeassistant/number/%s/battery_control/state", deviceID)
-	mqttClient.Subscribe(stateTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
+	// A maximum SOC set from Home Assistant overrides the configured value
+	stateTopic = fmt.Sprintf("%s/number/%s/maximum_soc/state", c.discoveryPrefix, c.deviceID)
+	bootstrapTopics = append(bootstrapTopics, stateTopic)
+	c.mqttClient.Subscribe(stateTopic, c.mqttQos, func(client mqtt.Client, msg mqtt.Message) {
 		value, err := strconv.Atoi(string(msg.Payload()))
-		if err == nil {
-			batteryControl = value
-			lastValidBatteryControl = value
+		if err == nil && value >= 0 && value <= 100 {
+			c.controlMu.Lock()
+			c.maximumSoc = value
+			c.controlMu.Unlock()
+			c.signalRestored("maximum_soc")
 		}
-		if debugEnabled {
-			log.Printf("Loaded battery_control from MQTT: %d", batteryControl)
+		c.logDebugf("Loaded maximum_soc from MQTT: %s", msg.Payload())
+	})
+
+	// A peak shave limit set from Home Assistant overrides the configured value
+	stateTopic = fmt.Sprintf("%s/number/%s/peak_shave_limit_w/state", c.discoveryPrefix, c.deviceID)
+	bootstrapTopics = append(bootstrapTopics, stateTopic)
+	c.mqttClient.Subscribe(stateTopic, c.mqttQos, func(client mqtt.Client, msg mqtt.Message) {
+		value, err := strconv.Atoi(string(msg.Payload()))
+		if err == nil && value >= 0 {
+			c.gridMu.Lock()
+			c.peakShaveLimitW = value
+			c.gridMu.Unlock()
+			c.signalRestored("peak_shave_limit_w")
 		}
+		c.logDebugf("Loaded peak_shave_limit_w from MQTT: %s", msg.Payload())
 	})
 
-	// bad work around for racecondition problem
-	// Delay to allow initial values to load
-	time.Sleep(500 * time.Millisecond) // Wait for subscriptions to take effect
+	// Wait until the bootstrap values have arrived, or at most initialSettingsTimeoutMs when some
+	// have no retained state (first start)
+	restored := make(map[string]bool, len(bootstrapTopics))
+	timeout := time.After(time.Duration(c.initialSettingsTimeoutMs) * time.Millisecond)
+wait:
+	for len(restored) < len(bootstrapTopics) {
+		select {
+		case name := <-c.restoredSettings:
+			restored[name] = true
+		case <-timeout:
+			c.logDebugf("Timed out after %dms waiting for retained settings", c.initialSettingsTimeoutMs)
+			break wait
+		}
+	}
+	for drained := false; !drained; {
+		select {
+		case name := <-c.restoredSettings:
+			restored[name] = true
+		default:
+			drained = true
+		}
+	}
+	// Discovery must not overwrite these retained states with the values it starts from
+	c.retainedStates = restored
+
+	// From here on the command handler owns these values; a later state republish must not
+	// overwrite a command received after startup
+	if token := c.mqttClient.Unsubscribe(bootstrapTopics...); token.WaitTimeout(2*time.Second) && token.Error() != nil {
+		c.logWarnf("Error unsubscribing from the startup state topics: %v", token.Error())
+	}
+
+	// Record which values arrived in time; anything later does not count as restored
+	for _, name := range []string{"automatic_logic_selection", "overwrite_logic_selection", "battery_control"} {
+		c.startupRestore[name] = "default"
+		if restored[name] {
+			c.startupRestore[name] = "restored"
+		}
+	}
+	c.logInfof("Startup restore: automatic_logic_selection=%s, overwrite_logic_selection=%s, battery_control=%s",
+		c.startupRestore["automatic_logic_selection"], c.startupRestore["overwrite_logic_selection"], c.startupRestore["battery_control"])
 
 	// Set defaults if no values are loaded
-	if automaticLogicSelection == "" {
-		automaticLogicSelection = "Automatic"
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	if c.automaticLogicSelection == "" {
+		c.automaticLogicSelection = "Automatic"
 	}
-	if overwriteLogicSelection == "" {
-		overwriteLogicSelection = "Off"
+	if c.overwriteLogicSelection == "" {
+		c.overwriteLogicSelection = "Off"
 	}
-	if batteryControl == 0 {
+	if c.batteryControl == 0 {
 		// Set default battery control to 90% of maximumBatteryControl
-		batteryControl = int(math.Round(float64(maximumBatteryControl) * 0.90))
-		lastValidBatteryControl = batteryControl
+		c.batteryControl = int(math.Round(float64(c.maximumBatteryControl) * 0.90))
+		c.lastValidBatteryControl = c.batteryControl
+		// The default differs from a retained 0, so its state is published
+		delete(c.retainedStates, "battery_control")
 	}
 
-	initialValuesLoaded = true // Mark that initial values have been loaded
+	c.initialValuesLoaded = true // Mark that initial values have been loaded
+}
+
+// signalRestored reports a bootstrap value received from retained state to loadInitialSettings.
+// Never blocks the MQTT callback: once the startup wait is over, further signals are dropped.
+func (c *Controller) signalRestored(name string) {
+	select {
+	case c.restoredSettings <- name:
+	default:
+	}
 }
 
-func mqttMessageHandler(client mqtt.Client, msg mqtt.Message) {
-	topicLevels := strings.Split(msg.Topic(), "/")
-	if len(topicLevels) < 5 {
+func (c *Controller) mqttMessageHandler(client mqtt.Client, msg mqtt.Message) {
+	// <discovery prefix>/<entity type>/<device id>/<object id>/<action>; the prefix may contain slashes
+	topicLevels := strings.Split(strings.TrimPrefix(msg.Topic(), c.discoveryPrefix+"/"), "/")
+	if len(topicLevels) < 4 {
 		return
 	}
-	entityType := topicLevels[1]
-	deviceID := topicLevels[2]
-	objectID := topicLevels[3]
-	action := topicLevels[4]
+	entityType := topicLevels[0]
+	deviceID := topicLevels[1]
+	objectID := topicLevels[2]
+	action := topicLevels[3]
 
 	payload := string(msg.Payload())
 
-	if debugEnabled {
-		log.Printf("Received MQTT message on %s: %s", msg.Topic(), payload)
-	}
+	c.logDebugf("Received MQTT message on %s: %s", msg.Topic(), payload)
 
 	if action != "set" {
 		return
@@ -753,54 +4435,424 @@ func mqttMessageHandler(client mqtt.Client, msg mqtt.Message) {
 	switch entityType {
 	case "select":
 		if objectID == "automatic_logic_selection" {
-			automaticLogicSelection = payload
-			stateTopic := fmt.Sprintf("homeassistant/select/%s/%s/state", deviceID, objectID)
-			mqttPublish(stateTopic, []byte(payload), true)
-			applyControlLogic()
-			lastChangeTime = time.Now()
+			c.controlMu.Lock()
+			c.automaticLogicSelection = payload
+			c.lastChangeTime = time.Now()
+			c.controlMu.Unlock()
+			stateTopic := fmt.Sprintf("%s/select/%s/%s/state", c.discoveryPrefix, deviceID, objectID)
+			c.mqttPublish(stateTopic, []byte(payload), true)
+			c.applyCommand(objectID, payload)
 		} else if objectID == "overwrite_logic_selection" {
-			overwriteLogicSelection = payload
-			stateTopic := fmt.Sprintf("homeassistant/select/%s/%s/state", deviceID, objectID)
-			mqttPublish(stateTopic, []byte(payload), true)
-			applyControlLogic()
-			lastChangeTime = time.Now()
+			c.controlMu.Lock()
+			c.overwriteLogicSelection = payload
+			c.lastChangeTime = time.Now()
+			c.controlMu.Unlock()
+			stateTopic := fmt.Sprintf("%s/select/%s/%s/state", c.discoveryPrefix, deviceID, objectID)
+			c.mqttPublish(stateTopic, []byte(payload), true)
+			c.applyCommand(objectID, payload)
+		}
+	case "switch":
+		if objectID == "debug_logging" {
+			// Off returns to the configured level (info if debug was configured)
+			level := configuredLogLevel
+			if payload == "ON" {
+				level = slog.LevelDebug
+			} else if level == slog.LevelDebug {
+				level = slog.LevelInfo
+			}
+			logLevel.Set(level)
+			c.logInfof("Log level set to %s from Home Assistant", level)
+			state := "OFF"
+			if debugLogging() {
+				state = "ON"
+			}
+			// The log level is process-wide, so the switch of every inverter follows it
+			for _, other := range controllers {
+				stateTopic := fmt.Sprintf("%s/switch/%s/%s/state", other.discoveryPrefix, other.deviceID, objectID)
+				other.mqttPublish(stateTopic, []byte(state), true)
+			}
+		}
+	case "button":
+		if objectID == "reset_error_count" {
+			c.logInfof("Modbus error count reset from Home Assistant (was %d)", c.modbusClientErrorCount.Swap(0))
+			c.publishSensorState("modbus_error_count", "0")
+			c.publishControllerStatus()
+			return
+		}
+		if objectID == "force_reconnect" {
+			c.logInfof("Modbus reconnect requested from Home Assistant")
+			// The read loop reconnects before its next poll
+			c.modbusMu.Lock()
+			c.modbusLastError = errors.New("reconnect requested from Home Assistant")
+			c.modbusReconnecting = true
+			c.modbusMu.Unlock()
+			c.requestPoll()
+			return
+		}
+		if !c.modeButtonsEnabled {
+			return
+		}
+		for _, mode := range logicOptions {
+			if modeButtonObjectID(mode) == objectID {
+				c.controlMu.Lock()
+				c.overwriteLogicSelection = mode
+				c.lastChangeTime = time.Now()
+				c.controlMu.Unlock()
+				stateTopic := fmt.Sprintf("%s/select/%s/overwrite_logic_selection/state", c.discoveryPrefix, deviceID)
+				c.mqttPublish(stateTopic, []byte(mode), true)
+				c.applyCommand("overwrite_logic_selection", mode)
+				break
+			}
 		}
 	case "number":
+		if (objectID == "raw_control_method" || objectID == "raw_power_command") && c.debugRawControl {
+			value, err := strconv.Atoi(payload)
+			if err != nil {
+				c.logWarnf("Invalid raw control value: %s", payload)
+				return
+			}
+			stateTopic := fmt.Sprintf("%s/number/%s/%s/state", c.discoveryPrefix, deviceID, objectID)
+			c.mqttPublish(stateTopic, []byte(payload), true)
+			c.applyRawControl(objectID, value)
+			return
+		}
+		if objectID == "minimum_soc" {
+			stateTopic := fmt.Sprintf("%s/number/%s/%s/state", c.discoveryPrefix, deviceID, objectID)
+			value, err := strconv.Atoi(payload)
+			c.controlMu.Lock()
+			current := c.minimumSoc
+			valid := err == nil && value >= 0 && value <= c.maximumSoc
+			if valid {
+				c.minimumSoc = value
+			}
+			c.controlMu.Unlock()
+			if !valid {
+				c.logWarnf("Invalid minimum SOC %s, keeping %d%%", payload, current)
+				c.mqttPublish(stateTopic, []byte(strconv.Itoa(current)), true)
+				return
+			}
+			c.mqttPublish(stateTopic, []byte(payload), true)
+			c.applyCommand(objectID, payload)
+			return
+		}
+		if objectID == "maximum_soc" {
+			stateTopic := fmt.Sprintf("%s/number/%s/%s/state", c.discoveryPrefix, deviceID, objectID)
+			value, err := strconv.Atoi(payload)
+			c.controlMu.Lock()
+			current := c.maximumSoc
+			valid := err == nil && value >= c.minimumSoc && value <= 100
+			if valid {
+				c.maximumSoc = value
+			}
+			c.controlMu.Unlock()
+			if !valid {
+				c.logWarnf("Invalid maximum SOC %s, keeping %d%%", payload, current)
+				c.mqttPublish(stateTopic, []byte(strconv.Itoa(current)), true)
+				return
+			}
+			c.mqttPublish(stateTopic, []byte(payload), true)
+			c.applyCommand(objectID, payload)
+			return
+		}
+		if objectID == "peak_shave_limit_w" {
+			stateTopic := fmt.Sprintf("%s/number/%s/%s/state", c.discoveryPrefix, deviceID, objectID)
+			value, err := strconv.Atoi(payload)
+			if err != nil || value < 0 {
+				c.gridMu.RLock()
+				current := c.peakShaveLimitW
+				c.gridMu.RUnlock()
+				c.logWarnf("Invalid peak shave limit %s, keeping %dW", payload, current)
+				c.mqttPublish(stateTopic, []byte(strconv.Itoa(current)), true)
+				return
+			}
+			c.gridMu.Lock()
+			c.peakShaveLimitW = value
+			c.gridMu.Unlock()
+			c.mqttPublish(stateTopic, []byte(payload), true)
+			c.applyCommand(objectID, payload)
+			return
+		}
 		if objectID == "battery_control" {
 			value, err := strconv.Atoi(payload)
-			if err == nil && value >= 0 && value <= maximumBatteryControl {
-				batteryControl = value
-				lastValidBatteryControl = value
-				stateTopic := fmt.Sprintf("homeassistant/number/%s/%s/state", deviceID, objectID)
-				mqttPublish(stateTopic, []byte(payload), true)
-				applyControlLogic()
-				lastChangeTime = time.Now()
+			c.controlMu.Lock()
+			valid := err == nil && value >= 0 && value <= c.maximumBatteryControl && c.batteryControlAllowedBySoc(value)
+			if valid {
+				c.batteryControl = value
+				c.lastValidBatteryControl = value
+				c.lastChangeTime = time.Now()
+			}
+			lastValid := c.lastValidBatteryControl
+			c.controlMu.Unlock()
+			stateTopic := fmt.Sprintf("%s/number/%s/%s/state", c.discoveryPrefix, deviceID, objectID)
+			if valid {
+				c.mqttPublish(stateTopic, []byte(payload), true)
+				c.applyCommand(objectID, payload)
 			} else {
 				// Reset to last valid value
-				stateTopic := fmt.Sprintf("homeassistant/number/%s/%s/state", deviceID, objectID)
-				mqttPublish(stateTopic, []byte(strconv.Itoa(lastValidBatteryControl)), true)
-				if debugEnabled {
-					log.Printf("Invalid battery control value: %s. Resetting to last valid value: %d", payload, lastValidBatteryControl)
-				}
+				c.mqttPublish(stateTopic, []byte(strconv.Itoa(lastValid)), true)
+				c.logDebugf("Invalid battery control value: %s. Resetting to last valid value: %d", payload, lastValid)
 			}
 		}
 	}
 }
 
-func mqttPublish(topic string, payload []byte, retain bool) {
-	token := mqttClient.Publish(topic, 0, retain, payload)
-	// For retained/config messages we wait; for high-frequency telemetry we don't block
-	if retain || debugEnabled {
+// applyRawControl writes raw_control_method/raw_power_command directly, bypassing applyMode.
+// A control method of 0 ends raw control and restores the normal control logic.
+func (c *Controller) applyRawControl(objectID string, value int) {
+	c.controlMu.Lock()
+	if objectID == "raw_control_method" {
+		c.rawSpntCom = uint32(value)
+	} else {
+		c.rawPwrAtCom = int32(value)
+	}
+	if c.rawSpntCom == 0 {
+		wasActive := c.rawControlActive
+		c.rawControlActive = false
+		if wasActive {
+			// Force the next evaluation to rewrite the mode's command over the raw one
+			c.previousMode = ""
+		}
+		c.controlMu.Unlock()
+		if wasActive {
+			c.logWarnf("raw control ended, restoring normal control logic")
+			c.applyControlLogic()
+		}
+		return
+	}
+	c.rawControlActive = true
+	c.logWarnf("raw control write bypassing control logic: SpntCom=%d, PwrAtCom=%d", c.rawSpntCom, c.rawPwrAtCom)
+	c.writeControlCommands(c.rawSpntCom, c.rawPwrAtCom)
+	c.controlMu.Unlock()
+	c.requestPoll()
+}
+
+// publishDecisionSnapshot publishes the inputs and outcome of a control decision: the branch taken
+// as the control_decision state and the full snapshot as its JSON attributes
+func (c *Controller) publishDecisionSnapshot(mode string, spntCom uint32, pwrAtCom int32) {
+	snapshot := map[string]interface{}{
+		"mode":            mode,
+		"branch":          c.decisionBranch,
+		"grid_draw":       c.inputs.gridDraw,
+		"grid_feed":       c.inputs.gridFeed,
+		"net_grid":        c.inputs.netGrid,
+		"battery_soc":     c.inputs.batterySoc,
+		"battery_control": c.batteryControl,
+		"spnt_com":        spntCom,
+		"pwr_at_com":      pwrAtCom,
+		"timestamp":       time.Now().Format(time.RFC3339),
+	}
+	payloadBytes, _ := json.Marshal(snapshot)
+	c.mqttPublish(c.sensorTopicPrefix+"control_decision/attributes", payloadBytes, false)
+	c.publishSensorState("control_decision", c.decisionBranch)
+}
+
+// publishRawRegister publishes what the inverter returned for a polled register (raw value, address,
+// width, scale and read time) to the sensor's attributes topic, including "not available" values
+func (c *Controller) publishRawRegister(name string, r regDef, raw uint64) {
+	payloadBytes, _ := json.Marshal(map[string]interface{}{
+		"raw":      raw,
+		"raw_hex":  fmt.Sprintf("0x%0*X", int(r.wordCount())*4, raw),
+		"address":  r.addr,
+		"words":    r.wordCount(),
+		"signed":   r.signed,
+		"scale":    r.scaleFactor(),
+		"read_at":  time.Now().Format(time.RFC3339),
+		"sentinel": r.isSentinel(raw, c.signedSentinels, c.unsignedSentinels),
+	})
+	c.mqttPublish(c.sensorTopicPrefix+name+"/attributes", payloadBytes, false)
+}
+
+// publishBuildInfo publishes the version as the build_info state, with commit, build date and Go
+// version as attributes
+func (c *Controller) publishBuildInfo() {
+	c.publishSensorState("build_info", version)
+	payloadBytes, _ := json.Marshal(map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"build_date": buildDate,
+		"go_version": runtime.Version(),
+	})
+	c.mqttPublish(c.sensorTopicPrefix+"build_info/attributes", payloadBytes, true)
+}
+
+// publishStartupRestoreState publishes how many bootstrap values were restored from retained MQTT
+// state, with the per-value result ("restored" or "default") as attributes
+func (c *Controller) publishStartupRestoreState() {
+	restored := 0
+	for _, result := range c.startupRestore {
+		if result == "restored" {
+			restored++
+		}
+	}
+	c.publishSensorState("startup_restore", fmt.Sprintf("%d/%d restored", restored, len(c.startupRestore)))
+	payloadBytes, _ := json.Marshal(c.startupRestore)
+	c.mqttPublish(c.sensorTopicPrefix+"startup_restore/attributes", payloadBytes, true)
+}
+
+// publishCommandAck publishes the acknowledgement of a command received over MQTT. confirmed is the
+// read-back result of the write the command caused and is only included when verified.
+func (c *Controller) publishCommandAck(ack commandAck, verified, confirmed bool) {
+	if c.ackTopic == "" {
+		return
+	}
+	c.controlMu.Lock()
+	if ack.mode == "" {
+		// Nothing was evaluated (eco, raw control, deferred)
+		ack.mode = c.currentLogicSelection
+	}
+	payload := map[string]interface{}{
+		"request_id":      ack.requestID,
+		"command":         ack.command,
+		"value":           ack.value,
+		"mode":            ack.mode,
+		"battery_control": c.batteryControl,
+		"written":         ack.written,
+		"spnt_com":        c.lastSpntCom,
+		"pwr_at_com":      c.lastPwrAtCom,
+		"timestamp":       time.Now().Format(time.RFC3339),
+	}
+	c.controlMu.Unlock()
+	if verified {
+		payload["confirmed"] = confirmed
+	}
+	payloadBytes, _ := json.Marshal(payload)
+	c.mqttPublish(c.ackTopic, payloadBytes, false)
+}
+
+// batteryControlAllowedBySoc checks a new battery_control against the SOC limits for the
+// direction the current mode would command. Always true when validation is off or SOC is unknown.
+// Callers hold controlMu.
+func (c *Controller) batteryControlAllowedBySoc(value int) bool {
+	c.gridMu.RLock()
+	defer c.gridMu.RUnlock()
+	if !c.validateControlSoc || !c.batterySocKnown || value == 0 {
+		return true
+	}
+	switch c.resolveMode() {
+	case "Discharge Battery", "Balanced":
+		if c.batterySoc <= c.minimumSoc {
+			c.logWarnf("Rejecting battery_control %d: discharge requested but SOC %d%% is at or below minimum %d%%", value, c.batterySoc, c.minimumSoc)
+			return false
+		}
+	case "Charge Battery":
+		if c.batterySoc >= c.maximumSoc {
+			c.logWarnf("Rejecting battery_control %d: charge requested but SOC %d%% is at or above maximum %d%%", value, c.batterySoc, c.maximumSoc)
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Controller) mqttPublish(topic string, payload []byte, retain bool) {
+	// Retained config and state use the configured QoS and wait for delivery
+	var qos byte
+	if retain {
+		qos = c.mqttQos
+	}
+	c.mqttPublishQos(topic, payload, qos, retain, retain)
+}
+
+// mqttPublishTelemetry publishes a high-frequency sensor value at QoS 0 without waiting for
+// delivery, whether it is retained (RETAIN_STATE) or not
+func (c *Controller) mqttPublishTelemetry(topic string, payload []byte) {
+	c.mqttPublishQos(topic, payload, 0, c.retainState, false)
+}
+
+// mqttPublishQos publishes with an explicit QoS; wait blocks until the client has handled the message
+func (c *Controller) mqttPublishQos(topic string, payload []byte, qos byte, retain, wait bool) {
+	token := c.mqttClient.Publish(topic, qos, retain, payload)
+	if wait || debugLogging() {
 		token.Wait()
 	} else {
 		// non-blocking publish; let the client handle delivery
 		go func() { _ = token.Wait() }()
 	}
-	if debugEnabled {
-		log.Printf("Published MQTT message to %s: %s", topic, payload)
+	c.logDebugf("Published MQTT message to %s: %s", topic, payload)
+}
+
+// setupLogging installs the slog default logger with the given level (debug, info, warn, error)
+// and format (text, json). Unknown values fall back to info and text.
+func setupLogging(level, format string) {
+	var invalid []string
+	switch level {
+	case "debug":
+		logLevel.Set(slog.LevelDebug)
+	case "info":
+		logLevel.Set(slog.LevelInfo)
+	case "warn", "warning":
+		logLevel.Set(slog.LevelWarn)
+	case "error":
+		logLevel.Set(slog.LevelError)
+	default:
+		logLevel.Set(slog.LevelInfo)
+		invalid = append(invalid, fmt.Sprintf("LOG_LEVEL %q", level))
+	}
+	configuredLogLevel = logLevel.Level()
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		handler = slog.NewTextHandler(os.Stderr, opts)
+		invalid = append(invalid, fmt.Sprintf("LOG_FORMAT %q", format))
+	}
+	slog.SetDefault(slog.New(handler))
+	for _, v := range invalid {
+		logWarnf("Invalid %s, using the default", v)
+	}
+}
+
+// debugLogging reports whether debug messages are logged
+func debugLogging() bool {
+	return logLevel.Level() <= slog.LevelDebug
+}
+
+func logf(level slog.Level, format string, args ...any) {
+	ctx := context.Background()
+	if !slog.Default().Enabled(ctx, level) {
+		return
+	}
+	slog.Log(ctx, level, fmt.Sprintf(format, args...))
+}
+
+func logDebugf(format string, args ...any) { logf(slog.LevelDebug, format, args...) }
+func logInfof(format string, args ...any)  { logf(slog.LevelInfo, format, args...) }
+func logWarnf(format string, args ...any)  { logf(slog.LevelWarn, format, args...) }
+func logErrorf(format string, args ...any) { logf(slog.LevelError, format, args...) }
+
+// logFatalf logs at error level and exits
+func logFatalf(format string, args ...any) {
+	logf(slog.LevelError, format, args...)
+	os.Exit(1)
+}
+
+// logf logs like the package-level logf, tagged with the device ID when several inverters run
+func (c *Controller) logf(level slog.Level, format string, args ...any) {
+	ctx := context.Background()
+	if !slog.Default().Enabled(ctx, level) {
+		return
+	}
+	if c.logDevice {
+		slog.Log(ctx, level, fmt.Sprintf(format, args...), "device", c.deviceID)
+	} else {
+		slog.Log(ctx, level, fmt.Sprintf(format, args...))
 	}
 }
 
+func (c *Controller) logDebugf(format string, args ...any) { c.logf(slog.LevelDebug, format, args...) }
+func (c *Controller) logInfof(format string, args ...any)  { c.logf(slog.LevelInfo, format, args...) }
+func (c *Controller) logWarnf(format string, args ...any)  { c.logf(slog.LevelWarn, format, args...) }
+func (c *Controller) logErrorf(format string, args ...any) { c.logf(slog.LevelError, format, args...) }
+
+// logFatalf logs at error level and exits
+func (c *Controller) logFatalf(format string, args ...any) {
+	c.logf(slog.LevelError, format, args...)
+	os.Exit(1)
+}
+
 func getEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -809,6 +4861,14 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
+// getEnv returns the inverter's override for key, falling back to the environment
+func (c *Controller) getEnv(key, defaultValue string) string {
+	if value, ok := c.env[key]; ok && value != "" {
+		return value
+	}
+	return getEnv(key, defaultValue)
+}
+
 func uint32ToBytes(value uint32) []byte {
 	bytes := make([]byte, 4)
 	binary.BigEndian.PutUint32(bytes, value)
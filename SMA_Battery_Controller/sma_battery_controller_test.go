@@ -0,0 +1,1039 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	modbus "github.com/goburrow/modbus"
+)
+
+// fakeWrite is one WriteMultipleRegisters call seen by fakeModbusClient
+type fakeWrite struct {
+	addr uint16
+	data []byte
+}
+
+// fakeModbusClient serves register reads from per-word maps and records every write. Written words
+// are stored as holding registers, so a read-back returns what was written last.
+type fakeModbusClient struct {
+	mu      sync.Mutex
+	input   map[uint16]uint16 // Input register words; a missing word answers with an illegal address exception
+	holding map[uint16]uint16 // Holding register words
+	writes  []fakeWrite
+	readErr error  // Returned by every read when set (transport error)
+	onRead  func() // Called before every holding register read when set
+}
+
+func newFakeModbusClient() *fakeModbusClient {
+	return &fakeModbusClient{input: map[uint16]uint16{}, holding: map[uint16]uint16{}}
+}
+
+func (f *fakeModbusClient) readWords(words map[uint16]uint16, address, quantity uint16) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.readErr != nil {
+		return nil, f.readErr
+	}
+	data := make([]byte, 0, quantity*2)
+	for i := uint16(0); i < quantity; i++ {
+		word, ok := words[address+i]
+		if !ok {
+			return nil, &modbus.ModbusError{FunctionCode: 4, ExceptionCode: modbus.ExceptionCodeIllegalDataAddress}
+		}
+		data = binary.BigEndian.AppendUint16(data, word)
+	}
+	return data, nil
+}
+
+func (f *fakeModbusClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	return f.readWords(f.input, address, quantity)
+}
+
+func (f *fakeModbusClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	if f.onRead != nil {
+		f.onRead()
+	}
+	return f.readWords(f.holding, address, quantity)
+}
+
+func (f *fakeModbusClient) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes = append(f.writes, fakeWrite{address, append([]byte{}, value...)})
+	for i := uint16(0); i < quantity; i++ {
+		f.holding[address+i] = binary.BigEndian.Uint16(value[i*2:])
+	}
+	return nil, nil
+}
+
+// setInput32 stores a U32/S32 input register value
+func (f *fakeModbusClient) setInput32(address uint16, value uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.input[address] = uint16(value >> 16)
+	f.input[address+1] = uint16(value)
+}
+
+// holding32 returns the 32-bit value of a holding register and whether it was ever written
+func (f *fakeModbusClient) holding32(address uint16) (uint32, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hi, ok := f.holding[address]
+	lo, ok2 := f.holding[address+1]
+	return uint32(hi)<<16 | uint32(lo), ok && ok2
+}
+
+// writeLog returns a copy of the recorded writes
+func (f *fakeModbusClient) writeLog() []fakeWrite {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeWrite{}, f.writes...)
+}
+
+// reset forgets the recorded writes and holding registers
+func (f *fakeModbusClient) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes = nil
+	f.holding = map[uint16]uint16{}
+}
+
+// fakeMqttClient records the last payload published per topic and completes every token at once.
+// Like a broker, it delivers the retained payload of a topic on subscribe.
+type fakeMqttClient struct {
+	mu        sync.Mutex
+	published map[string]string
+	retained  map[string]bool
+	handlers  map[string]mqtt.MessageHandler // Subscribed topics
+	broker    map[string]string              // Retained payloads delivered on subscribe
+}
+
+func newFakeMqttClient() *fakeMqttClient {
+	return &fakeMqttClient{published: map[string]string{}, retained: map[string]bool{},
+		handlers: map[string]mqtt.MessageHandler{}, broker: map[string]string{}}
+}
+
+func (f *fakeMqttClient) IsConnected() bool      { return true }
+func (f *fakeMqttClient) IsConnectionOpen() bool { return true }
+func (f *fakeMqttClient) Connect() mqtt.Token    { return &mqtt.DummyToken{} }
+func (f *fakeMqttClient) Disconnect(uint)        {}
+
+func (f *fakeMqttClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch p := payload.(type) {
+	case []byte:
+		f.published[topic] = string(p)
+	case string:
+		f.published[topic] = p
+	}
+	f.retained[topic] = retained
+	return &mqtt.DummyToken{}
+}
+
+func (f *fakeMqttClient) Subscribe(topic string, _ byte, handler mqtt.MessageHandler) mqtt.Token {
+	f.mu.Lock()
+	f.handlers[topic] = handler
+	payload, ok := f.broker[topic]
+	f.mu.Unlock()
+	if ok && handler != nil {
+		go handler(f, fakeMessage{topic, payload})
+	}
+	return &mqtt.DummyToken{}
+}
+
+func (f *fakeMqttClient) SubscribeMultiple(map[string]byte, mqtt.MessageHandler) mqtt.Token {
+	return &mqtt.DummyToken{}
+}
+
+func (f *fakeMqttClient) Unsubscribe(topics ...string) mqtt.Token {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, topic := range topics {
+		delete(f.handlers, topic)
+	}
+	return &mqtt.DummyToken{}
+}
+
+func (f *fakeMqttClient) AddRoute(string, mqtt.MessageHandler)    {}
+func (f *fakeMqttClient) OptionsReader() mqtt.ClientOptionsReader { return mqtt.ClientOptionsReader{} }
+
+// deliver passes a message to the handler subscribed to topic and reports whether there was one
+func (f *fakeMqttClient) deliver(topic, payload string) bool {
+	f.mu.Lock()
+	handler, ok := f.handlers[topic]
+	f.mu.Unlock()
+	if ok && handler != nil {
+		handler(f, fakeMessage{topic, payload})
+	}
+	return ok
+}
+
+// last returns the last payload published to topic
+func (f *fakeMqttClient) last(topic string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	payload, ok := f.published[topic]
+	return payload, ok
+}
+
+// newTestController builds a controller from env with fake Modbus and MQTT clients, ready to evaluate
+func newTestController(t *testing.T, env map[string]string) (*Controller, *fakeModbusClient, *fakeMqttClient) {
+	t.Helper()
+	c := newController(env, false)
+	fm := newFakeModbusClient()
+	fq := newFakeMqttClient()
+	c.modbusClient = fm
+	c.mqttClient = fq
+	c.controlInputsReady = true
+	return c, fm, fq
+}
+
+// testInputs are the polled values a test feeds into the control logic
+type testInputs struct {
+	gridDraw, gridFeed, charge, discharge, ac, dc1, dc2 int
+	soc                                                 int // -1 = unknown
+}
+
+// setInputs stores polled values the way readAndPublishData does
+func (c *Controller) setInputs(in testInputs) {
+	c.gridMu.Lock()
+	defer c.gridMu.Unlock()
+	c.gridDraw, c.gridFeed = in.gridDraw, in.gridFeed
+	c.netGrid = in.gridDraw - in.gridFeed
+	c.batteryChargePower, c.batteryDischargePower = in.charge, in.discharge
+	c.acPower, c.dc1Power, c.dc2Power = in.ac, in.dc1, in.dc2
+	c.batterySoc, c.batterySocKnown = in.soc, in.soc >= 0
+}
+
+func TestApplyModeWrites(t *testing.T) {
+	tests := []struct {
+		name           string
+		env            map[string]string
+		automatic      string
+		overwrite      string
+		batteryControl int
+		in             testInputs
+		written        bool // whether a command is expected at all
+		spntCom        uint32
+		pwrAtCom       int32
+	}{
+		{name: "automatic releases", automatic: "Automatic", overwrite: "Off", in: testInputs{soc: 50},
+			written: true, spntCom: 803, pwrAtCom: 0},
+		{name: "pause holds", automatic: "Automatic", overwrite: "Pause", in: testInputs{soc: 50},
+			written: true, spntCom: 802, pwrAtCom: 0},
+		{name: "pause charge ok holds a discharging battery", overwrite: "Pause (charge ok)", in: testInputs{gridDraw: 200, discharge: 500, soc: 50},
+			written: true, spntCom: 802, pwrAtCom: 0},
+		{name: "pause charge ok releases on feed-in", overwrite: "Pause (charge ok)", in: testInputs{gridFeed: 1000, soc: 50},
+			written: true, spntCom: 803, pwrAtCom: 0},
+		{name: "charge", overwrite: "Charge Battery", batteryControl: 3000, in: testInputs{soc: 50},
+			written: true, spntCom: 802, pwrAtCom: -3000},
+		{name: "discharge", overwrite: "Discharge Battery", batteryControl: 2500, in: testInputs{soc: 50},
+			written: true, spntCom: 802, pwrAtCom: 2500},
+		{name: "discharge at the reserve holds", env: map[string]string{"MINIMUM_SOC": "20"}, overwrite: "Discharge Battery", batteryControl: 2500,
+			in: testInputs{soc: 20}, written: true, spntCom: 802, pwrAtCom: 0},
+		{name: "balanced import raises the discharge", overwrite: "Balanced", batteryControl: 1000, in: testInputs{gridDraw: 500, discharge: 1000, soc: 50},
+			written: true, spntCom: 802, pwrAtCom: 1500},
+		{name: "balanced export to zero does not write", overwrite: "Balanced", batteryControl: 200, in: testInputs{gridFeed: 1000, discharge: 200, soc: 50},
+			written: false},
+		{name: "peak shaving discharges above the limit", env: map[string]string{"PEAK_SHAVE_LIMIT_W": "3000"}, overwrite: "Peak Shaving",
+			in: testInputs{gridDraw: 4500, soc: 50}, written: true, spntCom: 802, pwrAtCom: 1500},
+		{name: "zero export charges the feed-in", overwrite: "Zero Export", in: testInputs{gridFeed: 1500, soc: 50},
+			written: true, spntCom: 802, pwrAtCom: -1500},
+		{name: "zero export releases without feed-in", overwrite: "Zero Export", in: testInputs{gridDraw: 300, soc: 50},
+			written: true, spntCom: 803, pwrAtCom: 0},
+		{name: "clipping charge takes the DC excess", overwrite: "Clipping Charge", in: testInputs{ac: 5000, dc1: 6000, soc: 50},
+			written: true, spntCom: 802, pwrAtCom: -1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, fm, _ := newTestController(t, tt.env)
+			if tt.automatic != "" {
+				c.automaticLogicSelection = tt.automatic
+			}
+			c.overwriteLogicSelection = tt.overwrite
+			c.batteryControl = tt.batteryControl
+			c.setInputs(tt.in)
+
+			c.evaluateControl()
+
+			spntCom, spntOk := fm.holding32(c.controlRegister)
+			pwrAtCom, pwrOk := fm.holding32(c.powerRegister)
+			if !tt.written {
+				if len(fm.writeLog()) != 0 {
+					t.Fatalf("expected no write, got %v", fm.writeLog())
+				}
+				return
+			}
+			if !spntOk || !pwrOk {
+				t.Fatalf("expected 40151/40149 to be written, got %v", fm.writeLog())
+			}
+			if spntCom != tt.spntCom || int32(pwrAtCom) != tt.pwrAtCom {
+				t.Errorf("wrote SpntCom=%d PwrAtCom=%d, want %d %d", spntCom, int32(pwrAtCom), tt.spntCom, tt.pwrAtCom)
+			}
+		})
+	}
+}
+
+func TestWriteOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		addrs []uint16 // registers of the writes, in order
+		words []uint16 // quantity of each write
+	}{
+		{name: "default", env: nil, addrs: []uint16{40151, 40149}, words: []uint16{2, 2}},
+		{name: "control first", env: map[string]string{"WRITE_ORDER": "control_first"}, addrs: []uint16{40151, 40149}, words: []uint16{2, 2}},
+		{name: "power first", env: map[string]string{"WRITE_ORDER": "power_first"}, addrs: []uint16{40149, 40151}, words: []uint16{2, 2}},
+		{name: "invalid falls back to control first", env: map[string]string{"WRITE_ORDER": "sideways"}, addrs: []uint16{40151, 40149}, words: []uint16{2, 2}},
+		{name: "combined", env: map[string]string{"COMBINED_CONTROL_WRITE": "true"}, addrs: []uint16{40149}, words: []uint16{4}},
+		{name: "combined power first", env: map[string]string{"COMBINED_CONTROL_WRITE": "true", "WRITE_ORDER": "power_first"}, addrs: []uint16{40149}, words: []uint16{4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, fm, _ := newTestController(t, tt.env)
+			c.overwriteLogicSelection = "Discharge Battery"
+			c.batteryControl = 2000
+			c.setInputs(testInputs{soc: 50})
+
+			c.evaluateControl()
+
+			writes := fm.writeLog()
+			if len(writes) != len(tt.addrs) {
+				t.Fatalf("got %d writes %v, want %d", len(writes), writes, len(tt.addrs))
+			}
+			for i, w := range writes {
+				if w.addr != tt.addrs[i] || len(w.data) != int(tt.words[i])*2 {
+					t.Errorf("write %d: register %d, %d words; want %d, %d words", i, w.addr, len(w.data)/2, tt.addrs[i], tt.words[i])
+				}
+			}
+			// Whatever the order, the inverter ends up with the same command
+			spntCom, _ := fm.holding32(c.controlRegister)
+			pwrAtCom, _ := fm.holding32(c.powerRegister)
+			if spntCom != 802 || int32(pwrAtCom) != 2000 {
+				t.Errorf("registers hold SpntCom=%d PwrAtCom=%d, want 802 2000", spntCom, int32(pwrAtCom))
+			}
+		})
+	}
+}
+
+// Grid traces for the Balanced comparison: house load minus PV in W, one value per Balanced cycle.
+// eveningTrace only imports (cooking peak, kettle, heat pump); middayTrace swings between PV surplus
+// and import under passing clouds.
+var (
+	eveningTrace = []int{400, 420, 1800, 1850, 1900, 2400, 2300, 900, 650, 600, 3100, 3000, 2950, 800, 500, 450, 470, 2000, 2100, 400}
+	middayTrace  = []int{600, 400, -500, -1200, -1500, -1400, -900, 300, 1200, -800, -2000, -2100, 500, 700}
+)
+
+// balancedRun is the outcome of simulateBalanced
+type balancedRun struct {
+	imported, exported int     // Sum of the positive/negative net grid over the trace (W per cycle)
+	commands           []int32 // Battery power after each cycle (> 0 discharging, < 0 charging)
+}
+
+// simulateBalanced runs Balanced with the given algorithm over trace. The plant is an inverter that
+// holds the last written command: the battery delivers PwrAtCom while 40151 is 802 and nothing otherwise.
+func simulateBalanced(t *testing.T, env map[string]string, trace []int) balancedRun {
+	t.Helper()
+	c, fm, _ := newTestController(t, env)
+	c.overwriteLogicSelection = "Balanced"
+	c.batteryControl = 500
+	var run balancedRun
+	battery := 0
+	for _, load := range trace {
+		net := load - battery
+		in := testInputs{soc: 50}
+		if net > 0 {
+			in.gridDraw = net
+			run.imported += net
+		} else {
+			in.gridFeed = -net
+			run.exported -= net
+		}
+		if battery > 0 {
+			in.discharge = battery
+		} else {
+			in.charge = -battery
+		}
+		c.setInputs(in)
+		c.evaluateControl()
+		spntCom, _ := fm.holding32(c.controlRegister)
+		pwrAtCom, _ := fm.holding32(c.powerRegister)
+		battery = 0
+		if spntCom == c.controlOn {
+			battery = int(int32(pwrAtCom))
+		}
+		if battery > c.maximumBatteryControl || battery < -c.maximumBatteryControl {
+			t.Fatalf("battery command %dW beyond maximum_battery_control", battery)
+		}
+		run.commands = append(run.commands, int32(battery))
+	}
+	return run
+}
+
+func TestBalancedAlgorithmsOnGridTraces(t *testing.T) {
+	// A combined write skips the pause between the two register writes, which keeps the runs fast
+	legacyEnv := map[string]string{"BALANCED_ALGORITHM": "legacy", "COMBINED_CONTROL_WRITE": "true"}
+	proportionalEnv := map[string]string{"BALANCED_ALGORITHM": "proportional", "COMBINED_CONTROL_WRITE": "true"}
+
+	t.Run("evening import", func(t *testing.T) {
+		// While the house only imports, proportional is a drop-in for legacy: the same discharge commands
+		legacy := simulateBalanced(t, legacyEnv, eveningTrace)
+		proportional := simulateBalanced(t, proportionalEnv, eveningTrace)
+		for i := range legacy.commands {
+			if legacy.commands[i] != proportional.commands[i] {
+				t.Fatalf("cycle %d: legacy %dW, proportional %dW", i, legacy.commands[i], proportional.commands[i])
+			}
+		}
+		if proportional.imported != legacy.imported {
+			t.Errorf("imported %d (proportional) vs %d (legacy)", proportional.imported, legacy.imported)
+		}
+	})
+
+	t.Run("midday surplus", func(t *testing.T) {
+		// Legacy is discharge-only; proportional charges the surplus and exports less
+		legacy := simulateBalanced(t, legacyEnv, middayTrace)
+		proportional := simulateBalanced(t, proportionalEnv, middayTrace)
+		for i, cmd := range legacy.commands {
+			if cmd < 0 {
+				t.Errorf("legacy charged %dW in cycle %d", -cmd, i)
+			}
+		}
+		charged := false
+		for _, cmd := range proportional.commands {
+			charged = charged || cmd < 0
+		}
+		if !charged {
+			t.Errorf("proportional never charged: %v", proportional.commands)
+		}
+		if proportional.exported >= legacy.exported {
+			t.Errorf("exported %d (proportional), want less than %d (legacy)", proportional.exported, legacy.exported)
+		}
+	})
+}
+
+func TestBalancedConvergesAcrossGains(t *testing.T) {
+	// Plant: a constant 2500W house load and a battery that covers half of the remaining difference to
+	// its command each cycle (ramp-limited inverter). Starting from an idle battery the net grid has to
+	// enter balanced_deadband_w for good within maxSteps, still be there hold steps later, and never
+	// export more than maxOvershoot on the way. A higher gain overshoots the lagging battery further
+	// and needs a few more cycles to settle.
+	const (
+		load = 2500
+		hold = 10
+	)
+	gains := []struct {
+		gain         string
+		maxSteps     int
+		maxOvershoot int // W of export
+	}{
+		{gain: "0.5", maxSteps: 15, maxOvershoot: 500},
+		{gain: "1.0", maxSteps: 15, maxOvershoot: 1000},
+		{gain: "1.5", maxSteps: 20, maxOvershoot: 1250},
+	}
+	for _, tt := range gains {
+		for _, algorithm := range []string{"legacy", "proportional"} {
+			t.Run(algorithm+"/gain "+tt.gain, func(t *testing.T) {
+				c, fm, _ := newTestController(t, map[string]string{"BALANCED_ALGORITHM": algorithm, "BALANCED_GAIN": tt.gain, "COMBINED_CONTROL_WRITE": "true"})
+				c.overwriteLogicSelection = "Balanced"
+				c.batteryControl = 300
+				battery := 0.0
+				settled := -1
+				overshoot := 0
+				for step := 0; step < tt.maxSteps+hold; step++ {
+					net := load - int(math.Round(battery))
+					overshoot = max(overshoot, -net)
+					inDeadband := net <= c.balancedDeadbandW && net >= -c.balancedDeadbandW
+					if !inDeadband {
+						settled = -1
+					} else if settled < 0 {
+						settled = step
+					}
+					in := testInputs{discharge: int(math.Round(battery)), soc: 50}
+					if net > 0 {
+						in.gridDraw = net
+					} else {
+						in.gridFeed = -net
+					}
+					c.setInputs(in)
+					c.evaluateControl()
+					spntCom, _ := fm.holding32(c.controlRegister)
+					pwrAtCom, _ := fm.holding32(c.powerRegister)
+					command := 0.0
+					if spntCom == c.controlOn {
+						command = float64(int32(pwrAtCom))
+					}
+					battery += (command - battery) / 2
+				}
+				if settled < 0 || settled > tt.maxSteps {
+					t.Fatalf("net grid did not settle in the %dW deadband within %d steps (settled in step %d)", c.balancedDeadbandW, tt.maxSteps, settled)
+				}
+				if overshoot > tt.maxOvershoot {
+					t.Errorf("net grid overshot to %dW export, want at most %dW", overshoot, tt.maxOvershoot)
+				}
+			})
+		}
+	}
+}
+
+func TestSoftStartAdvancesOnlyOnWrite(t *testing.T) {
+	c, fm, _ := newTestController(t, map[string]string{
+		"SOFT_START_CYCLES":     "4",
+		"MIN_WRITE_INTERVAL_MS": "60000",
+		"MIN_WRITE_DELTA_W":     "50",
+	})
+	c.overwriteLogicSelection = "Charge Battery"
+	c.batteryControl = 100
+	c.setInputs(testInputs{soc: 50})
+
+	c.evaluateControl() // step 1: -25W, written
+	c.evaluateControl() // step 2: -50W, within MIN_WRITE_DELTA_W of the last write and skipped
+	if n := len(fm.writeLog()); n != 2 {
+		t.Fatalf("expected only the first command to be written, got %v", fm.writeLog())
+	}
+	if c.softStartStep != 1 {
+		t.Errorf("softStartStep = %d after a skipped write, want 1", c.softStartStep)
+	}
+
+	c.minWriteIntervalMs = 0
+	c.evaluateControl() // step 2 again, now written
+	if pwrAtCom, _ := fm.holding32(c.powerRegister); int32(pwrAtCom) != -50 {
+		t.Errorf("wrote PwrAtCom=%d, want -50", int32(pwrAtCom))
+	}
+	if c.softStartStep != 2 {
+		t.Errorf("softStartStep = %d after the write, want 2", c.softStartStep)
+	}
+}
+
+func TestApplySocLimits(t *testing.T) {
+	// Reserve at 20%, ceiling at 90% with the default 5% hysteresis
+	env := map[string]string{"MINIMUM_SOC": "20", "MAXIMUM_SOC": "90"}
+	tests := []struct {
+		name     string
+		mode     string
+		spntCom  uint32
+		pwrAtCom int32
+		soc      int // -1 = unknown
+		want     int32
+	}{
+		{"discharge above the reserve", "Discharge Battery", 802, 2000, 21, 2000},
+		{"discharge at the reserve", "Discharge Battery", 802, 2000, 20, 0},
+		{"discharge below the reserve", "Discharge Battery", 802, 2000, 19, 0},
+		{"charge below the ceiling", "Charge Battery", 802, -2000, 89, -2000},
+		{"charge at the ceiling", "Charge Battery", 802, -2000, 90, 0},
+		{"charge above the ceiling", "Charge Battery", 802, -2000, 91, 0},
+		{"charge at the reserve", "Charge Battery", 802, -2000, 20, -2000},
+		{"discharge at the ceiling", "Discharge Battery", 802, 2000, 90, 2000},
+		{"balanced discharge at the reserve", "Balanced", 802, 1500, 20, 0},
+		{"balanced charge at the ceiling", "Balanced", 802, -1500, 90, 0},
+		{"peak shaving at the reserve", "Peak Shaving", 802, 1500, 20, 0},
+		{"clipping charge at the ceiling", "Clipping Charge", 802, -1500, 90, 0},
+		{"schedule discharge at the reserve", "Schedule", 802, 1500, 19, 0},
+		{"schedule charge at the ceiling", "Schedule", 802, -1500, 91, 0},
+		{"zero export is left to its own ceiling handling", "Zero Export", 802, -1500, 95, -1500},
+		{"unknown SOC allows discharge", "Discharge Battery", 802, 2000, -1, 2000},
+		{"unknown SOC allows charge", "Charge Battery", 802, -2000, -1, -2000},
+		{"released control is untouched", "Discharge Battery", 803, 2000, 10, 2000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _, _ := newTestController(t, env)
+			c.inputs = controlInputs{batterySoc: tt.soc, batterySocKnown: tt.soc >= 0}
+			spntCom, pwrAtCom := tt.spntCom, tt.pwrAtCom
+			c.applySocLimits(tt.mode, &spntCom, &pwrAtCom)
+			if pwrAtCom != tt.want || spntCom != tt.spntCom {
+				t.Errorf("got SpntCom=%d PwrAtCom=%d, want %d %d", spntCom, pwrAtCom, tt.spntCom, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateSocCeilingHysteresis(t *testing.T) {
+	// Ceiling 90% with 5% hysteresis: latched at 90, released at 85 or below
+	c, _, _ := newTestController(t, map[string]string{"MAXIMUM_SOC": "90", "SOC_HYSTERESIS": "5"})
+	steps := []struct {
+		soc     int // -1 = unknown
+		reached bool
+	}{
+		{84, false},
+		{89, false},
+		{90, true},
+		{91, true},
+		{89, true},
+		{86, true},
+		{-1, true}, // an unknown SOC keeps the latch
+		{85, false},
+		{86, false},
+		{89, false},
+		{90, true},
+		{84, false},
+	}
+	for i, step := range steps {
+		c.inputs = controlInputs{batterySoc: step.soc, batterySocKnown: step.soc >= 0}
+		c.updateSocCeiling()
+		if c.socCeilingReached != step.reached {
+			t.Fatalf("step %d (SOC %d%%): ceiling reached %v, want %v", i, step.soc, c.socCeilingReached, step.reached)
+		}
+	}
+}
+
+// fakeMessage is an incoming MQTT message for mqttMessageHandler
+type fakeMessage struct {
+	topic   string
+	payload string
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 0 }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return []byte(m.payload) }
+func (m fakeMessage) Ack()              {}
+
+// TestConcurrentCommandsAndControl runs MQTT commands, the read loop's control evaluation, the
+// health endpoint and the MQTT connection callbacks at the same time. Run it with -race.
+func TestConcurrentCommandsAndControl(t *testing.T) {
+	c, _, fq := newTestController(t, map[string]string{
+		"MQTT_DISCONNECT_MODE":          "Pause",
+		"MQTT_DISCONNECT_GRACE_SECONDS": "0",
+		"OVERWRITE_TIMEOUT_MINUTES":     "1",
+		"COMBINED_CONTROL_WRITE":        "true",
+		"DEBUG_RAW_CONTROL":             "true",
+	})
+	c.setInputs(testInputs{gridDraw: 800, discharge: 300, soc: 50})
+	set := func(entity, objectID, payload string) {
+		topic := c.discoveryPrefix + "/" + entity + "/" + c.deviceID + "/" + objectID + "/set"
+		c.mqttMessageHandler(fq, fakeMessage{topic, payload})
+	}
+
+	const rounds = 20
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				f(i)
+			}
+		}()
+	}
+	modes := []string{"Balanced", "Pause (charge ok)", "Charge Battery", "Off"}
+	run(func(i int) {
+		set("select", "overwrite_logic_selection", modes[i%len(modes)])
+		set("select", "automatic_logic_selection", modes[(i+1)%len(modes)])
+	})
+	run(func(i int) {
+		set("number", "battery_control", strconv.Itoa(1000+i*10))
+		set("number", "minimum_soc", strconv.Itoa(10+i%10))
+	})
+	run(func(i int) {
+		set("number", "peak_shave_limit_w", strconv.Itoa(3000+i))
+	})
+	run(func(int) {
+		// Answered with the current limit while the goroutine above changes it
+		set("number", "peak_shave_limit_w", "-1")
+	})
+	run(func(int) {
+		c.checkPauseChargeOkMode()
+		c.checkOverwriteTimeout()
+		c.checkMqttDisconnect()
+		c.readAndPublishData()
+	})
+	run(func(int) {
+		c.health()
+		c.lastPoll()
+		c.batteryControlSetpoint()
+		c.overwriteSelection()
+	})
+	run(func(i int) {
+		if i%2 == 0 {
+			c.onMqttConnectionLost(errors.New("test"))
+		} else {
+			c.onMqttConnect(fq)
+		}
+	})
+	run(func(i int) {
+		// Raw control takes over and hands back on every other round
+		set("number", "raw_control_method", strconv.Itoa(802*(i%2)))
+	})
+	wg.Wait()
+
+	// Balanced adjusts battery_control itself, so only its range is checked
+	if got := c.batteryControlSetpoint(); got < 0 || got > c.maximumBatteryControl {
+		t.Errorf("battery_control = %d, want 0..%d", got, c.maximumBatteryControl)
+	}
+}
+
+// TestSensorCacheConcurrentFullPublish clears the sensor cache while sensors are published from
+// several goroutines. Run it with -race.
+func TestSensorCacheConcurrentFullPublish(t *testing.T) {
+	c, _, fq := newTestController(t, nil)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				c.publishSensorState("sensor_"+strconv.Itoa(g), strconv.Itoa(i/10))
+			}
+		}(g)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			c.forceFullPublish()
+		}
+	}()
+	wg.Wait()
+
+	if got := c.publishesTotal.Load() + c.publishesSuppressedTotal.Load(); got != 4*200 {
+		t.Errorf("published + suppressed = %d, want %d", got, 4*200)
+	}
+	for g := 0; g < 4; g++ {
+		if got, _ := fq.last(c.sensorTopicPrefix + "sensor_" + strconv.Itoa(g) + "/state"); got != "19" {
+			t.Errorf("sensor_%d state = %q, want the last value 19", g, got)
+		}
+	}
+	// After a full publish the next poll sends an unchanged value again
+	c.forceFullPublish()
+	before := c.publishesTotal.Load()
+	c.publishSensorState("sensor_0", "19")
+	if c.publishesTotal.Load() != before+1 {
+		t.Error("unchanged value was suppressed after forceFullPublish")
+	}
+}
+
+// TestInitialSettingsDoNotClobberCommands restores the retained number states at startup and then
+// checks that a late republish of a stale state no longer overrides a command from Home Assistant
+func TestInitialSettingsDoNotClobberCommands(t *testing.T) {
+	c, _, fq := newTestController(t, map[string]string{"INITIAL_SETTINGS_TIMEOUT_MS": "2000"})
+	c.controlInputsReady = false
+	c.setInputs(testInputs{soc: 50})
+	topic := func(entity, objectID, action string) string {
+		return c.discoveryPrefix + "/" + entity + "/" + c.deviceID + "/" + objectID + "/" + action
+	}
+	fq.broker[topic("select", "automatic_logic_selection", "state")] = "Automatic"
+	fq.broker[topic("select", "overwrite_logic_selection", "state")] = "Off"
+	fq.broker[topic("number", "battery_control", "state")] = "1500"
+	fq.broker[topic("number", "minimum_soc", "state")] = "15"
+	fq.broker[topic("number", "maximum_soc", "state")] = "85"
+	fq.broker[topic("number", "peak_shave_limit_w", "state")] = "4000"
+	c.loadInitialSettings()
+
+	if c.minimumSoc != 15 || c.maximumSoc != 85 || c.peakShaveLimitW != 4000 {
+		t.Fatalf("restored minimum_soc=%d maximum_soc=%d peak_shave_limit_w=%d, want 15, 85, 4000",
+			c.minimumSoc, c.maximumSoc, c.peakShaveLimitW)
+	}
+
+	commands := []struct {
+		entity, objectID, command, stale string
+		get                              func() int
+		want                             int
+	}{
+		{"number", "battery_control", "2000", "1500", func() int { return c.batteryControl }, 2000},
+		{"number", "minimum_soc", "30", "15", func() int { return c.minimumSoc }, 30},
+		{"number", "maximum_soc", "95", "85", func() int { return c.maximumSoc }, 95},
+		{"number", "peak_shave_limit_w", "2500", "4000", func() int { return c.peakShaveLimitW }, 2500},
+	}
+	for _, cmd := range commands {
+		c.mqttMessageHandler(fq, fakeMessage{topic(cmd.entity, cmd.objectID, "set"), cmd.command})
+		if fq.deliver(topic(cmd.entity, cmd.objectID, "state"), cmd.stale) {
+			t.Errorf("%s: still subscribed to the state topic after startup", cmd.objectID)
+		}
+		if got := cmd.get(); got != cmd.want {
+			t.Errorf("%s = %d after a stale state, want the command %d", cmd.objectID, got, cmd.want)
+		}
+	}
+	for _, objectID := range []string{"automatic_logic_selection", "overwrite_logic_selection"} {
+		if fq.deliver(topic("select", objectID, "state"), "Balanced") {
+			t.Errorf("%s: still subscribed to the state topic after startup", objectID)
+		}
+	}
+}
+
+func TestParseSpeedwireIdentity(t *testing.T) {
+	// Reply of an inverter with SUSy-ID 372 and serial 3012345678 to the identification query
+	reply := append([]byte{}, speedwireIdentifyRequest...)
+	reply[20], reply[21] = 0x7d, 0x00
+	binary.LittleEndian.PutUint16(reply[28:30], 372)
+	binary.LittleEndian.PutUint32(reply[30:34], 3012345678)
+	meter := append([]byte{}, reply...)
+	binary.BigEndian.PutUint16(meter[16:18], 0x6069)
+
+	tests := []struct {
+		name   string
+		packet []byte
+		susyID uint16
+		serial uint32
+		ok     bool
+	}{
+		{"inverter reply", reply, 372, 3012345678, true},
+		{"own query", speedwireIdentifyRequest, 0, 0, false},
+		{"energy meter", meter, 0, 0, false},
+		{"discovery reply", speedwireDiscoveryRequest, 0, 0, false},
+		{"truncated", reply[:30], 0, 0, false},
+		{"not speedwire", append([]byte("XMA\x00"), reply[4:]...), 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			susyID, serial, ok := parseSpeedwireIdentity(tt.packet)
+			if susyID != tt.susyID || serial != tt.serial || ok != tt.ok {
+				t.Errorf("got (%d, %d, %t), want (%d, %d, %t)", susyID, serial, ok, tt.susyID, tt.serial, tt.ok)
+			}
+		})
+	}
+}
+
+func TestUntilNextScheduleBoundary(t *testing.T) {
+	c, _, _ := newTestController(t, map[string]string{
+		"SCHEDULE":          `[{"start":"22:00","end":"06:00","action":"charge"},{"start":"17:00","end":"21:00","action":"discharge"}]`,
+		"SCHEDULE_TIMEZONE": "Europe/Berlin",
+	})
+	tests := []struct {
+		now  string
+		want time.Duration
+	}{
+		{"2026-10-17T21:30:00+02:00", 30 * time.Minute}, // next start 22:00
+		{"2026-10-17T23:00:00+02:00", 7 * time.Hour},    // overnight window ends 06:00
+		{"2026-10-17T17:00:00+02:00", 4 * time.Hour},    // at a start, the next boundary is its end
+		{"2026-10-17T19:00:00Z", time.Hour},             // 21:00 in Berlin
+		{"2026-10-25T01:00:00+02:00", 6 * time.Hour},    // DST ends overnight, 06:00 CET
+	}
+	for _, tt := range tests {
+		now, err := time.Parse(time.RFC3339, tt.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.untilNextScheduleBoundary(now); got != tt.want {
+			t.Errorf("%s: next boundary in %s, want %s", tt.now, got, tt.want)
+		}
+	}
+}
+
+// TestPostWriteReadbackWithoutControlMu checks that the read-back reads and rewrites a command the
+// inverter did not take without holding controlMu, and records the result
+func TestPostWriteReadbackWithoutControlMu(t *testing.T) {
+	c, fm, fq := newTestController(t, map[string]string{
+		"WRITE_READBACK_VERIFY": "true",
+		"POST_COMMAND_DELAY_MS": "1",
+	})
+	c.overwriteLogicSelection = "Discharge Battery"
+	c.batteryControl = 2000
+	c.setInputs(testInputs{soc: 50})
+	c.applyControlLogic()
+	req := c.readbackPending
+	if req == nil {
+		t.Fatal("no read-back requested after the write")
+	}
+	// The inverter did not take the power setpoint; the rewrite fixes it
+	fm.mu.Lock()
+	fm.holding[40149], fm.holding[40150] = 0, 0
+	fm.mu.Unlock()
+	reads := 0
+	fm.onRead = func() {
+		reads++
+		if !c.controlMu.TryLock() {
+			t.Error("controlMu held during a read-back read")
+			return
+		}
+		c.controlMu.Unlock()
+	}
+
+	c.postWriteReadback(req)
+
+	if reads < 4 {
+		t.Errorf("%d holding reads, want a read-back, a rewrite and a second read-back", reads)
+	}
+	if !c.lastCommandConfirmed {
+		t.Error("lastCommandConfirmed = false after the rewrite was read back")
+	}
+	if got, _ := fq.last(c.sensorTopicPrefix + "last_command_confirmed/state"); got != "on" {
+		t.Errorf("last_command_confirmed = %q, want on", got)
+	}
+}
+
+func TestIsSentinel(t *testing.T) {
+	signed, unsigned := []uint32{0x80000000}, []uint32{0xFFFFFFFF, 0xFFFFFFFD}
+	s32 := regDef{name: "s32", signed: true}
+	u32 := regDef{name: "u32"}
+	s64 := regDef{name: "s64", signed: true, words: 4}
+	u64 := regDef{name: "u64", words: 4}
+	tests := []struct {
+		name string
+		reg  regDef
+		raw  uint64
+		want bool
+	}{
+		{"S32 NaN", s32, 0x80000000, true},
+		{"S32 -1 is a reading", s32, 0xFFFFFFFF, false},
+		{"S32 reading", s32, 1500, false},
+		{"U32 NaN", u32, 0xFFFFFFFF, true},
+		{"U32 0xFFFFFFFD", u32, 0xFFFFFFFD, true},
+		{"U32 0x80000000 is a reading", u32, 0x80000000, false},
+		{"U32 reading", u32, 55, false},
+		{"S64 NaN", s64, 0x8000000000000000, true},
+		{"S64 -1 is a reading", s64, math.MaxUint64, false},
+		{"U64 NaN", u64, math.MaxUint64, true},
+		{"U64 32-bit NaN is a reading", u64, 0xFFFFFFFF, false},
+		{"U64 reading", u64, 123456789, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.reg.isSentinel(tt.raw, signed, unsigned); got != tt.want {
+				t.Errorf("isSentinel(0x%X) = %v, want %v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSentinels(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []uint32
+		wantErr bool
+	}{
+		{"0x80000000", []uint32{0x80000000}, false},
+		{"0xFFFFFFFF,0xFFFFFFFD", []uint32{0xFFFFFFFF, 0xFFFFFFFD}, false},
+		{" 4294967295 , 0x8000 ,", []uint32{0xFFFFFFFF, 0x8000}, false},
+		{"", nil, false},
+		{"0x1FFFFFFFF", nil, true},
+		{"-1", nil, true},
+		{"NaN", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSentinels(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSentinels(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseSentinels(%q) = %v, want %v", tt.value, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseSentinels(%q) = %v, want %v", tt.value, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+// TestReadAndPublishDataSkipsSentinels polls a signed and an unsigned sentinel after valid readings:
+// neither is published, and the control inputs drop to no power and an unknown SOC
+func TestReadAndPublishDataSkipsSentinels(t *testing.T) {
+	c, fm, fq := newTestController(t, nil)
+	dc1Topic := c.sensorTopicPrefix + "dc1_power/state"
+	socTopic := c.sensorTopicPrefix + "battery_soc/state"
+	fm.setInput32(30773, 800) // dc1_power, S32
+	fm.setInput32(30845, 55)  // battery_soc, U32
+	c.readAndPublishData()
+	dc1, _ := fq.last(dc1Topic)
+	soc, _ := fq.last(socTopic)
+	if dc1 == "" || soc == "" {
+		t.Fatalf("valid readings not published: dc1_power %q, battery_soc %q", dc1, soc)
+	}
+
+	fm.setInput32(30773, 0x80000000)
+	fm.setInput32(30845, 0xFFFFFFFF)
+	c.forceFullPublish()
+	c.readAndPublishData()
+
+	if got, _ := fq.last(dc1Topic); got != dc1 {
+		t.Errorf("dc1_power published %q for the signed sentinel, want the last reading %q", got, dc1)
+	}
+	if got, _ := fq.last(socTopic); got != soc {
+		t.Errorf("battery_soc published %q for the unsigned sentinel, want the last reading %q", got, soc)
+	}
+	c.gridMu.RLock()
+	defer c.gridMu.RUnlock()
+	if c.dc1Power != 0 || c.batterySocKnown {
+		t.Errorf("dc1Power = %d, batterySocKnown = %v; want 0, false", c.dc1Power, c.batterySocKnown)
+	}
+}
+
+func TestReadWatchdogCountsFullPolls(t *testing.T) {
+	c, fm, _ := newTestController(t, map[string]string{"READ_WATCHDOG_SECONDS": "60"})
+	stale := time.Now().Add(-2 * time.Minute)
+	c.lastFullPoll = stale
+	c.readWatchdogRestarts = 2
+
+	// Every register but dc1_power is rejected with an exception: the inverter answered, the poll counts
+	fm.setInput32(30773, 800)
+	c.readAndPublishData()
+	if !c.lastFullPoll.After(stale) || c.readWatchdogRestarts != 0 {
+		t.Fatalf("lastFullPoll = %s, readWatchdogRestarts = %d after a poll without read errors; want now, 0", c.lastFullPoll, c.readWatchdogRestarts)
+	}
+	c.checkReadWatchdog()
+	if c.readWatchdogRestarts != 0 {
+		t.Errorf("watchdog tripped %d times right after a successful poll", c.readWatchdogRestarts)
+	}
+}
+
+func TestGridPowerSensor(t *testing.T) {
+	c, fm, fq := newTestController(t, nil)
+	topic := c.sensorTopicPrefix + "grid_power/state"
+	tests := []struct {
+		draw, feed uint32
+		want       string
+	}{
+		{300, 0, "300"},  // importing
+		{0, 500, "-500"}, // exporting
+		{0, 0, "0"},
+	}
+	for _, tt := range tests {
+		fm.setInput32(30865, tt.draw)
+		fm.setInput32(30867, tt.feed)
+		c.readAndPublishData()
+		if got, _ := fq.last(topic); got != tt.want {
+			t.Errorf("draw %d, feed %d: grid_power = %q, want %q", tt.draw, tt.feed, got, tt.want)
+		}
+		if net, _ := fq.last(c.sensorTopicPrefix + "net_grid/state"); net != tt.want {
+			t.Errorf("draw %d, feed %d: net_grid = %q, want %q", tt.draw, tt.feed, net, tt.want)
+		}
+	}
+}
+
+// TestAutomaticInitialWriteReadback checks that the first Automatic evaluation uses the 40151 value
+// read on the read loop and does not read Modbus itself
+func TestAutomaticInitialWriteReadback(t *testing.T) {
+	tests := []struct {
+		name   string
+		method uint32 // 40151 at startup
+		writes int
+	}{
+		{"external control is released", 802, 2},
+		{"internal control is left alone", 803, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, fm, _ := newTestController(t, map[string]string{"AUTOMATIC_INITIAL_WRITE": "readback"})
+			c.setInputs(testInputs{soc: 50})
+			fm.mu.Lock()
+			fm.holding[40151], fm.holding[40152] = uint16(tt.method>>16), uint16(tt.method)
+			fm.mu.Unlock()
+			reads := 0
+			fm.onRead = func() { reads++ }
+
+			c.applyControlLogic()
+			if reads != 0 || len(fm.writeLog()) != 0 || !c.controlDeferred {
+				t.Fatalf("before the 40151 read: %d reads, %d writes, deferred %v; want 0, 0, true", reads, len(fm.writeLog()), c.controlDeferred)
+			}
+			c.readInitialControlMethod()
+			if reads != 1 {
+				t.Errorf("%d holding reads, want the one 40151 read", reads)
+			}
+			if got := len(fm.writeLog()); got != tt.writes {
+				t.Errorf("%d writes, want %d", got, tt.writes)
+			}
+		})
+	}
+}